@@ -0,0 +1,93 @@
+// assets.go implements fingerprinted asset URLs for cache-busting.
+
+package caviar
+
+import (
+    "html/template"
+    "path"
+    "strings"
+)
+
+// Default URL prefix for AssetURL().
+const ASSET_URL_PREFIX = "/static/"
+
+// Cache-Control header sent along fingerprinted files (see AssetURL()).
+const IMMUTABLE_CACHE_CONTROL = "public, max-age=31536000, immutable"
+
+// SetAssetBase sets the URL prefix AssetURL() returns URLs under, and the
+// bundle directory (a slash-separated path relative to the object root) a
+// FileServer serves there. They default to ASSET_URL_PREFIX and the object
+// root.
+func SetAssetBase(url, dir string) {
+    if !strings.HasSuffix(url, "/") { url += "/" }
+    state.assetURL = url
+    state.assetDir = path.Clean(dir)
+}
+
+// AssetURL returns the fingerprinted URL of a bundle file, given its path
+// relative to the asset directory (see SetAssetBase()). For instance,
+// “css/app.css” becomes “/static/css/app.3f2a9c1d.css”. FileServer maps such
+// names back to the file they came from and serves it with a far-future,
+// immutable Cache-Control header. Files that aren't in the bundle (or were
+// modified through the writable overlay) get a plain URL.
+func AssetURL(name string) string {
+    prefix, dir := state.assetURL, state.assetDir
+    if prefix == "" { prefix = ASSET_URL_PREFIX }
+    if dir == "" { dir = "." }
+
+    name = strings.TrimPrefix(path.Clean("/" + name), "/")
+    plain := prefix + name
+
+    rel := path.Join(dir, name)
+    if state.overlay != nil {
+        if _, err := state.overlay.stat(rel); err == nil { return plain }
+        if whiteedOut(rel) { return plain }
+    }
+
+    obj, err := lookupObject(rel)
+    if err != nil || obj.ModeBits.IsDir() || obj.Fingerprint == "" { return plain }
+
+    return prefix + fingerprintName(name, obj.Fingerprint)
+}
+
+// FuncMap returns template functions for html/template (or text/template,
+// which uses the same type): “asset” maps to AssetURL.
+//
+//     <link rel="stylesheet" href="{{ asset "css/app.css" }}">
+func FuncMap() template.FuncMap {
+    return template.FuncMap{ "asset": AssetURL }
+}
+
+// Insert a fingerprint into a file name, before its extension.
+func fingerprintName(name, fp string) string {
+    ext := path.Ext(name)
+    return strings.TrimSuffix(name, ext) + "." + fp + ext
+}
+
+// Split a fingerprinted file name into the original name and the fingerprint.
+// Returns false if the name doesn't look fingerprinted.
+func splitFingerprint(name string) (orig, fp string, ok bool) {
+    dir, base := path.Split(name)
+    ext := path.Ext(base)
+    stem := strings.TrimSuffix(base, ext)
+
+    // name.FP.ext
+    if i := strings.LastIndex(stem, "."); i > 0 && isHex(stem[i+1:]) {
+        return dir + stem[:i] + ext, stem[i+1:], true
+    }
+
+    // name.FP
+    if stem != "" && isHex(strings.TrimPrefix(ext, ".")) {
+        return dir + stem, ext[1:], true
+    }
+
+    return "", "", false
+}
+
+func isHex(s string) bool {
+    if s == "" { return false }
+    for _, c := range s {
+        if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') { return false }
+    }
+    return true
+}
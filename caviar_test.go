@@ -0,0 +1,334 @@
+package caviar
+
+import (
+    "archive/zip"
+    "bytes"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/gob"
+    "encoding/hex"
+    "errors"
+    "hash/crc32"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+// Contents of the bundle loaded by TestMain, by slash-separated path. Paths
+// ending in "/" are (empty) directories. Files under "ext/" are external.
+var testFiles = map[string]string{
+    "index.html":       "<html><body>Hello!</body></html>",
+    "empty.txt":        "",
+    "emptydir/":        "",
+    "sub/a.txt":        "a",
+    "sub/deeper/b.txt": strings.Repeat("b", 1000),
+    "big.bin":          testData(300 * 1024),
+    "ext/big.bin":      testData(300 * 1024),
+}
+
+// Return n bytes of data that doesn't repeat too often, so reads from the
+// wrong offset show.
+func testData(n int) string {
+    data := make([]byte, n)
+    for i := range data { data[i] = byte(i % 251) }
+    return string(data)
+}
+
+// Directory the test bundle's asset root is mounted at.
+var testPrefix string
+
+func TestMain(m *testing.M) {
+    dir, err := ioutil.TempDir("", "caviar-test")
+    if err != nil { panic(err) }
+
+    code := 1
+    func() {
+        defer os.RemoveAll(dir)
+
+        name := filepath.Join(dir, "test." + CAVIAR_EXTENSION)
+        data, err := testContainer(testFiles)
+        if err != nil { panic(err) }
+        err = ioutil.WriteFile(name, data, 0644)
+        if err != nil { panic(err) }
+
+        testPrefix = filepath.Join(dir, "assets")
+        err = loadTestBundle(name, testPrefix)
+        if err != nil { panic(err) }
+
+        code = m.Run()
+    }()
+
+    os.Exit(code)
+}
+
+// File contents that stand for a whiteout in testBundle().
+const testWhiteout = "\x00whiteout"
+
+// Build a container the way cavundle would, holding files (see testFiles).
+func testContainer(files map[string]string) ([]byte, error) {
+    data, _, err := testBundle("", files)
+    return data, err
+}
+
+// Build a container holding files (see testFiles) and return it along with its
+// digest. If base isn't empty, the container is a patch bundle applying to the
+// bundle with that digest, and files set to testWhiteout are whiteouts. Files
+// named *.js get a precompressed gzip variant. The edit functions, if any, are
+// called on the manifest before it's digested.
+func testBundle(base string, files map[string]string, edit ...func(*Manifest)) ([]byte, string, error) {
+    m := new(Manifest)
+    m.Magic = MANIFEST_MAGIC
+    m.BaseDigest = base
+    m.ObjectRoot.Name = OBJECTROOT_MAGIC
+    m.ObjectRoot.ModeBits = os.ModeDir | 0755
+    m.Options.ExtractionMode = EXTRACT_MEMORY
+
+    names := make([]string, 0, len(files))
+    for name := range files { names = append(names, name) }
+    sort.Strings(names)
+
+    var assets, ext bytes.Buffer
+    for _, name := range names {
+        obj := testObject(&m.ObjectRoot, strings.TrimSuffix(name, "/"))
+        if strings.HasSuffix(name, "/") {
+            obj.ModeBits = os.ModeDir | 0755
+            continue
+        }
+        if files[name] == testWhiteout {
+            *obj = Object{ Name: obj.Name, Whiteout: true }
+            continue
+        }
+
+        data := []byte(files[name])
+        sum := sha256.Sum256(data)
+        obj.ModeBits = 0644
+        obj.Size = int64(len(data))
+        obj.Sha256 = hex.EncodeToString(sum[:])
+        if obj.Size == 0 { continue }
+
+        buf := &assets
+        if strings.HasPrefix(name, "ext/") {
+            obj.External = true
+            buf = &ext
+        }
+        obj.Offset = int64(buf.Len())
+        obj.Checksum = crc32.ChecksumIEEE(data)
+        buf.Write(data)
+
+        if strings.HasSuffix(name, ".js") {
+            var gz bytes.Buffer
+            w := gzip.NewWriter(&gz)
+            w.Write(data)
+            err := w.Close()
+            if err != nil { return nil, "", err }
+
+            obj.GzipOffset = int64(buf.Len())
+            obj.GzipSize = int64(gz.Len())
+            obj.GzipChecksum = crc32.ChecksumIEEE(gz.Bytes())
+            buf.Write(gz.Bytes())
+        }
+    }
+    for _, f := range edit { f(m) }
+    m.Digest = Digest(m, assets.Bytes())
+
+    var out bytes.Buffer
+    zw := zip.NewWriter(&out)
+
+    f, err := zw.Create("Manifest.gob")
+    if err != nil { return nil, "", err }
+    err = gob.NewEncoder(f).Encode(*m)
+    if err != nil { return nil, "", err }
+
+    f, err = zw.Create("Assets.bin")
+    if err != nil { return nil, "", err }
+    _, err = f.Write(assets.Bytes())
+    if err != nil { return nil, "", err }
+
+    if ext.Len() != 0 {
+        f, err = zw.CreateHeader(&zip.FileHeader{ Name: "External.bin", Method: zip.Store })
+        if err != nil { return nil, "", err }
+        _, err = f.Write(ext.Bytes())
+        if err != nil { return nil, "", err }
+    }
+
+    err = zw.Close()
+    if err != nil { return nil, "", err }
+    return out.Bytes(), m.Digest, nil
+}
+
+// Return the object at a slash-separated path under root, creating it (and any
+// missing parent directories) if needed.
+func testObject(root *Object, name string) *Object {
+    obj := root
+    for _, segment := range strings.Split(name, "/") {
+        i := childIndex(obj, segment)
+        if i < 0 {
+            obj.Objects = append(obj.Objects, Object{ Name: segment, ModeBits: os.ModeDir | 0755 })
+            i = len(obj.Objects) - 1
+        }
+        obj = &obj.Objects[i]
+    }
+    return obj
+}
+
+// Load a container file as Init() would, with its asset root at prefix.
+func loadTestBundle(name, prefix string) error {
+    c, err := openContainer(name)
+    if err != nil { return err }
+
+    state.prefix = prefix
+    err = loadContainer(c, name, CONTAINER_DETACHED)
+    if err != nil { return err }
+
+    state.ready = true
+    return nil
+}
+
+// Load the container named name on a clean slate, with its asset root next to
+// it, and run f. The test bundle is back in place afterwards.
+func testWithBundle(t *testing.T, name string, f func()) {
+    saved := state
+    state = caviarState{}
+    defer func() {
+        for _, file := range state.files { file.Close() }
+        state = saved
+    }()
+
+    err := loadTestBundle(name, filepath.Join(filepath.Dir(name), "assets"))
+    if err != nil { t.Fatal(err) }
+    f()
+}
+
+// Read a file through ReadFile(), returning an empty string and the error if
+// it can't be read.
+func testRead(name string) (string, error) {
+    data, err := ReadFile(name)
+    return string(data), err
+}
+
+func TestChdir(t *testing.T) {
+    wd, err := os.Getwd()
+    if err != nil { t.Fatal(err) }
+    defer func() {
+        state.cwd = ""
+        os.Chdir(wd)
+    }()
+
+    // A native directory, and the asset root also present on disk
+    native := t.TempDir()
+    err = ioutil.WriteFile(filepath.Join(native, "n.txt"), []byte("native"), 0644)
+    if err != nil { t.Fatal(err) }
+    both := testPrefix
+    err = os.MkdirAll(both, 0755)
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(both)
+    err = ioutil.WriteFile(filepath.Join(both, "x.txt"), []byte("native x.txt"), 0644)
+    if err != nil { t.Fatal(err) }
+
+    sub := filepath.Join(testPrefix, "sub")
+    steps := []struct {
+        dir         string
+        wd          string      // Getwd() afterwards
+        oswd        string      // os.Getwd() afterwards
+        file, data  string      // a relative path and what it reads
+    }{
+        // Only in the bundle: the process' directory stays put.
+        { sub, sub, wd, "a.txt", "a" },
+        { "deeper", filepath.Join(sub, "deeper"), wd, "b.txt", testFiles["sub/deeper/b.txt"] },
+        { "..", sub, wd, filepath.Join("deeper", "b.txt"), testFiles["sub/deeper/b.txt"] },
+        { filepath.Join("..", "emptydir"), filepath.Join(testPrefix, "emptydir"), wd, filepath.Join("..", "index.html"), testFiles["index.html"] },
+        // Only on disk: relative paths go to the os package.
+        { native, native, native, "n.txt", "native" },
+        // In both: bundle files win, the rest falls back to disk.
+        { both, both, both, "index.html", testFiles["index.html"] },
+        { ".", both, both, "x.txt", "native x.txt" },
+    }
+
+    for _, s := range steps {
+        err = Chdir(s.dir)
+        if err != nil { t.Fatalf("Chdir(%v) failed: %v", s.dir, err) }
+
+        got, err := Getwd()
+        if err != nil || got != s.wd { t.Fatalf("Chdir(%v): Getwd() returned %v, %v, want %v.", s.dir, got, err, s.wd) }
+        got, err = os.Getwd()
+        if err != nil || got != s.oswd { t.Fatalf("Chdir(%v): os.Getwd() returned %v, %v, want %v.", s.dir, got, err, s.oswd) }
+        got, err = testRead(s.file)
+        if err != nil || got != s.data { t.Fatalf("Chdir(%v): read %v as %q, %v.", s.dir, s.file, got, err) }
+    }
+
+    // Failed calls leave the working directory alone.
+    for dir, want := range map[string]error{ "missing": os.ErrNotExist, filepath.Join(sub, "a.txt"): syscall.ENOTDIR } {
+        err = Chdir(dir)
+        if !errors.Is(err, want) { t.Errorf("Chdir(%v) returned %v, want %v.", dir, err, want) }
+    }
+    if got, _ := Getwd(); got != both { t.Errorf("Getwd() returned %v after failed Chdir(), want %v.", got, both) }
+}
+
+func TestMounts(t *testing.T) {
+    saved := Mounts()
+    defer func() { state.mounts = saved }()
+
+    mnt := filepath.Join(t.TempDir(), "mnt")
+    b := testFiles["sub/deeper/b.txt"]
+    for _, m := range []Mount{
+        { "sub", mnt },
+        // Nested in another mount, and in the asset root
+        { "sub/deeper", filepath.Join(mnt, "inner") },
+        { "sub", filepath.Join(testPrefix, "emptydir") },
+    } {
+        err := AddMount(m.Source, m.Target)
+        if err != nil { t.Fatal(err) }
+    }
+
+    // Relative paths are resolved against the virtual working directory.
+    defer func() { state.cwd = "" }()
+    err := Chdir(filepath.Join(mnt, "inner"))
+    if err != nil { t.Fatal(err) }
+
+    // Lookups go to the mount with the longest matching target.
+    reads := []struct {
+        name, data  string
+    }{
+        { filepath.Join(mnt, "a.txt"), "a" },
+        { filepath.Join(mnt, "deeper", "b.txt"), b },
+        { filepath.Join(mnt, "inner", "b.txt"), b },
+        { filepath.Join(mnt, "inner", "a.txt"), "" },
+        { "b.txt", b },
+        { filepath.Join("..", "a.txt"), "a" },
+        { filepath.Join(testPrefix, "emptydir", "a.txt"), "a" },
+        { filepath.Join(testPrefix, "index.html"), testFiles["index.html"] },
+    }
+    check := func(what string) {
+        for _, r := range reads {
+            got, err := testRead(r.name)
+            if got != r.data || (err == nil) != (r.data != "") {
+                t.Errorf("%v: read %v as %q, %v, want %q.", what, r.name, got, err, r.data)
+            }
+        }
+    }
+    check("Mounted")
+
+    // Replacing and removing mounts
+    err = AddMount("sub/deeper", mnt)
+    if err != nil { t.Fatal(err) }
+    reads[0].data, reads[1].data, reads[5].data = "", "", ""
+    reads = append(reads, struct{ name, data string }{ filepath.Join(mnt, "b.txt"), b })
+    check("Replaced")
+
+    err = RemoveMount(mnt)
+    if err != nil { t.Fatal(err) }
+    reads[len(reads) - 1].data = ""
+    check("Removed")
+
+    // Errors
+    err = RemoveMount(mnt)
+    if !errors.Is(err, syscall.EINVAL) { t.Errorf("RemoveMount() of a missing mount returned %v.", err) }
+    err = AddMount("sub", "relative")
+    if !errors.Is(err, os.ErrInvalid) { t.Errorf("AddMount() to a relative path returned %v.", err) }
+    err = AddMount("missing", mnt)
+    if !errors.Is(err, os.ErrNotExist) { t.Errorf("AddMount() of a missing source returned %v.", err) }
+}
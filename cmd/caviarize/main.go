@@ -63,6 +63,15 @@ var patchList = [...]string{
     "http.Dir",
     "ioutil.ReadDir",
     "ioutil.ReadFile",
+    "os.ReadDir",
+    "os.ReadFile",
+    "os.Chdir",
+    "os.Getwd",
+}
+
+// Replacements not named after the function they replace.
+var patchRenames = map[string]string{
+    "os.ReadDir": "caviar.ReadDirEntries",
 }
 
 var patchFixups = [...]string{
@@ -120,6 +129,7 @@ func patchFile(fpath string, info os.FileInfo, err error) error {
     for _, find := range patchList {
         tmp := strings.Split(find, ".")
         replace := "caviar." + tmp[1]
+        if rename, ok := patchRenames[find]; ok { replace = rename }
         code = strings.Replace(code, find, replace, -1)
     }
 
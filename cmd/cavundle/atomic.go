@@ -0,0 +1,45 @@
+// atomic.go implements atomic file output, so a crash halfway through never
+// leaves a corrupted executable or container behind.
+
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+// Produce the file name by having fn write to a temporary file in the same
+// directory, which is then synced, given the mode bits and renamed over it.
+// fn receives the temporary file's name rather than an open file as external
+// tools like zip and objcopy may replace it.
+func writeAtomic(name string, mode os.FileMode, fn func(tmp string) error) error {
+    dir := filepath.Dir(name)
+    fp, err := ioutil.TempFile(dir, "." + filepath.Base(name) + ".")
+    if err != nil { return err }
+    tmp := fp.Name()
+    fp.Close()
+    defer os.Remove(tmp)
+
+    err = fn(tmp)
+    if err != nil { return err }
+
+    // Flush to disk
+    fp, err = os.OpenFile(tmp, os.O_RDWR, 0)
+    if err != nil { return err }
+    err = fp.Sync()
+    fp.Close()
+    if err != nil { return err }
+
+    err = os.Chmod(tmp, mode)
+    if err != nil { return err }
+
+    err = os.Rename(tmp, name)
+    if err != nil { return err }
+
+    // Make the rename itself durable
+    d, err := os.Open(dir)
+    if err != nil { return err }
+    defer d.Close()
+    return d.Sync()
+}
@@ -0,0 +1,207 @@
+// delta.go implements the “delta” command, which produces patch bundles
+// holding only the differences between a base bundle (plus the patches already
+// made for it) and a new asset tree.
+
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/mvillalba/caviar"
+)
+
+// Load the base container named base, merged with every patch numbered before
+// output (see caviar.PatchNames()), and return the resulting manifest along
+// with the digest the new patch should reference: that of the last layer.
+func loadBase(base, output string) (*caviar.Manifest, string, error) {
+    manifest, digest, err := loadContainer(base)
+    if err != nil { return nil, "", err }
+    if manifest.BaseDigest != "" {
+        return nil, "", errors.New("Can't compute a delta against a patch bundle: " + base)
+    }
+
+    seq, err := caviar.PatchSequence(output)
+    if err != nil { return nil, "", err }
+
+    // The patches already made are those next to the new one, named after the
+    // same program.
+    stem := strings.TrimSuffix(output, "." + caviar.PATCH_EXTENSION)
+    patches, err := caviar.PatchNames(strings.TrimSuffix(stem, filepath.Ext(stem)))
+    if err != nil { return nil, "", err }
+
+    for _, name := range patches {
+        pseq, _ := caviar.PatchSequence(name)
+        if pseq == seq { continue }
+        if pseq > seq {
+            return nil, "", errors.New("Patch " + output + " must be numbered after existing patch " + name)
+        }
+
+        patch, pdigest, err := loadContainer(name)
+        if err != nil { return nil, "", err }
+        if patch.BaseDigest != digest {
+            return nil, "", errors.New("Patch " + name + " doesn't apply on top of the patches before it")
+        }
+        caviar.MergePatch(manifest, patch)
+        digest = pdigest
+    }
+
+    return manifest, digest, nil
+}
+
+// Load a container (detached, attached to an executable or embedded in its
+// ELF section) and return its manifest along with the digest it should be
+// referenced by.
+func loadContainer(name string) (*caviar.Manifest, string, error) {
+    file, err := os.Open(name)
+    if err != nil { return nil, "", err }
+    defer file.Close()
+
+    container, err := caviar.FindContainer(file)
+    if err != nil { return nil, "", err }
+
+    reader, err := zip.NewReader(container, container.Size())
+    if err != nil { return nil, "", err }
+
+    var manifest *caviar.Manifest
+    var assets []byte
+    for _, f := range reader.File {
+        if f.Name != "Manifest.gob" && f.Name != "Assets.bin" { continue }
+        r, err := f.Open()
+        if err != nil { return nil, "", err }
+        if f.Name == "Manifest.gob" {
+            manifest = new(caviar.Manifest)
+            err = gob.NewDecoder(r).Decode(manifest)
+        } else {
+            assets, err = ioutil.ReadAll(r)
+        }
+        r.Close()
+        if err != nil { return nil, "", err }
+    }
+    if manifest == nil || assets == nil {
+        return nil, "", errors.New("Not a Caviar container: " + name)
+    }
+
+    digest := caviar.Digest(manifest, assets)
+    if manifest.Digest != "" && manifest.Digest != digest {
+        return nil, "", errors.New("Container digest mismatch: " + name)
+    }
+
+    return manifest, digest, nil
+}
+
+// Compare two objects of the same type and name. Modification times are
+// ignored so that touching a file doesn't land it in the patch.
+func objectChanged(old, new *caviar.Object) bool {
+    if old.ModeBits != new.ModeBits || old.Size != new.Size || old.Checksum != new.Checksum || old.External != new.External {
+        return true
+    }
+    if old.Uid != new.Uid || old.Gid != new.Gid || old.MimeType != new.MimeType {
+        return true
+    }
+    if (old.GzipSize == 0) != (new.GzipSize == 0) { return true }
+    if old.Sha256 != new.Sha256 { return true }
+    if len(old.Xattrs) != len(new.Xattrs) || len(old.Tags) != len(new.Tags) {
+        return true
+    }
+    for i := 0; i < len(old.Xattrs); i++ {
+        if old.Xattrs[i].Name != new.Xattrs[i].Name || !bytes.Equal(old.Xattrs[i].Value, new.Xattrs[i].Value) {
+            return true
+        }
+    }
+    for i := 0; i < len(old.Tags); i++ {
+        if old.Tags[i] != new.Tags[i] { return true }
+    }
+    return false
+}
+
+// Deep-copy an object, moving its payload (and that of its children) from src
+// into dst.
+func copyObject(obj *caviar.Object, src *Payload, dst *Payload) caviar.Object {
+    c := *obj
+    c.Objects = nil
+    if c.Size != 0 {
+        buf := src.assets.Bytes()
+        if obj.External { buf = src.external.Bytes() }
+        dst.add(&c, buf[obj.Offset:obj.Offset+obj.Size])
+        if c.GzipSize != 0 { dst.addGzip(&c, buf[obj.GzipOffset:obj.GzipOffset+obj.GzipSize]) }
+    }
+    for i := 0; i < len(obj.Objects); i++ {
+        c.Objects = append(c.Objects, copyObject(&obj.Objects[i], src, dst))
+    }
+    return c
+}
+
+// Compute the patch object for a directory present in both the old and the
+// new bundle. Payloads for changed and added files are taken from src and
+// written to dst.
+func diffDirectory(old, new *caviar.Object, src *Payload, dst *Payload) (patch caviar.Object, changed bool) {
+    patch = *new
+    patch.Objects = nil
+    changed = objectChanged(old, new)
+
+    oldchildren := make(map[string]*caviar.Object)
+    for i := 0; i < len(old.Objects); i++ {
+        oldchildren[old.Objects[i].Name] = &old.Objects[i]
+    }
+
+    // Added and changed objects
+    for i := 0; i < len(new.Objects); i++ {
+        nobj := &new.Objects[i]
+        oobj, ok := oldchildren[nobj.Name]
+        delete(oldchildren, nobj.Name)
+
+        if ok && oobj.ModeBits.IsDir() && nobj.ModeBits.IsDir() {
+            sub, subchanged := diffDirectory(oobj, nobj, src, dst)
+            if subchanged {
+                patch.Objects = append(patch.Objects, sub)
+                changed = true
+            }
+            continue
+        }
+
+        if !ok || objectChanged(oobj, nobj) {
+            patch.Objects = append(patch.Objects, copyObject(nobj, src, dst))
+            changed = true
+        }
+    }
+
+    // Deleted objects
+    for i := 0; i < len(old.Objects); i++ {
+        if _, ok := oldchildren[old.Objects[i].Name]; !ok { continue }
+        patch.Objects = append(patch.Objects, caviar.Object{ Name: old.Objects[i].Name, Whiteout: true })
+        changed = true
+    }
+
+    return patch, changed
+}
+
+// Produce a patch bundle that turns the base container named by
+// args.executable, along with the patches numbered before args.output, into a
+// bundle of args.paths.
+func delta(args Args) {
+    base, digest, err := loadBase(args.executable, args.output)
+    if err != nil { log.Fatal(err) }
+
+    manifest, payloads, err := processAssets(args)
+    if err != nil { log.Fatal(err) }
+
+    patch := new(Payload)
+    root, _ := diffDirectory(&base.ObjectRoot, &manifest.ObjectRoot, payloads, patch)
+    manifest.ObjectRoot = root
+    manifest.BaseDigest = digest
+
+    container, err := buildContainer(manifest, patch, args)
+    if err != nil { log.Fatal(err) }
+
+    err = writeAtomic(args.output, 0644, func(tmp string) error {
+        return ioutil.WriteFile(tmp, container.Bytes(), 0600)
+    })
+    if err != nil { log.Fatal(err) }
+}
@@ -0,0 +1,54 @@
+// elf.go implements embedding containers in a dedicated ELF section, which
+// (unlike appended containers) survives strip, objcopy and friends.
+
+package main
+
+import (
+    "bytes"
+    "debug/elf"
+    "errors"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "strconv"
+    "github.com/mvillalba/caviar"
+)
+
+// Section alignment, so the container can be mmapped straight from the
+// executable.
+const ELF_ALIGNMENT = 4096
+
+// Embed a container in an ELF executable as a new section. Requires objcopy.
+func embedELF(fpath string, container *bytes.Buffer) error {
+    f, err := elf.Open(fpath)
+    if err != nil { return errors.New("Not an ELF executable: " + err.Error()) }
+    f.Close()
+
+    tmp, err := ioutil.TempFile("", "caviar")
+    if err != nil { return err }
+    defer os.Remove(tmp.Name())
+
+    _, err = container.WriteTo(tmp)
+    if err == nil { err = tmp.Close() }
+    if err != nil { return err }
+
+    // objcopy ignores the alignment of sections added in the same run, so
+    // it takes two.
+    section := caviar.ELF_SECTION
+    err = objcopy(fpath,
+        "--add-section", section + "=" + tmp.Name(),
+        "--set-section-flags", section + "=contents,readonly")
+    if err != nil { return err }
+
+    return objcopy(fpath, "--set-section-alignment", section + "=" + strconv.Itoa(ELF_ALIGNMENT))
+}
+
+// Run objcopy on a file in place.
+func objcopy(fpath string, args ...string) error {
+    cmd := exec.Command("objcopy", append(args, fpath)...)
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return errors.New("objcopy error: " + err.Error() + ": " + string(bytes.TrimSpace(out)))
+    }
+    return nil
+}
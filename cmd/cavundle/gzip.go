@@ -0,0 +1,59 @@
+// gzip.go implements the -gzip option, which stores precompressed variants of
+// compressible files for caviar.FileServer.
+
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "strings"
+    "github.com/mvillalba/caviar"
+)
+
+// Variants that don't save at least this fraction of the original size are
+// discarded.
+const GZIP_MIN_SAVINGS = 0.1
+
+// MIME types worth compressing, besides text/*.
+var compressibleTypes = []string{
+    "application/javascript",
+    "application/json",
+    "application/manifest+json",
+    "application/wasm",
+    "application/xhtml+xml",
+    "application/xml",
+    "image/svg+xml",
+    "image/x-icon",
+    "font/otf",
+    "font/ttf",
+}
+
+// Report whether files of the given MIME type are worth compressing.
+func compressible(mtype string) bool {
+    mtype = strings.TrimSpace(strings.SplitN(mtype, ";", 2)[0])
+    if strings.HasPrefix(mtype, "text/") { return true }
+    for _, t := range compressibleTypes {
+        if mtype == t { return true }
+    }
+    return false
+}
+
+// Attach a precompressed gzip variant of payload to obj, if it's compressible
+// (going by its MIME type) and compression pays off.
+func processGzip(obj *caviar.Object, payload []byte, payloads *Payload) error {
+    if !compressible(obj.MimeType) { return nil }
+
+    // The gzip header carries no name nor mtime, so output is reproducible.
+    var buf bytes.Buffer
+    w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+    if err != nil { return err }
+    _, err = w.Write(payload)
+    if err != nil { return err }
+    err = w.Close()
+    if err != nil { return err }
+
+    if float64(buf.Len()) > float64(len(payload)) * (1 - GZIP_MIN_SAVINGS) { return nil }
+
+    payloads.addGzip(obj, buf.Bytes())
+    return nil
+}
@@ -16,58 +16,281 @@ import (
     "io/ioutil"
     "errors"
     "hash/crc32"
+    "encoding/json"
+    "mime"
+    "net/http"
+    "sort"
+    "strings"
+    "crypto/sha256"
+    "encoding/hex"
 )
 
 const MANIFEST_COMMENT =
 `Generated by the Caviar resource packer for Go (http://github.com/mvillalba/caviar).
 Copyright © 2014 Martín Raúl Villalba (http://www.martinvillalba.com/).`
 
+// Number of hex digits in file fingerprints.
+const FINGERPRINT_LENGTH = 8
+
 type Args struct {
     cherrypick  bool
     detached    bool
     debug       bool
+    meta        bool
+    tagfile     string
+    mimefile    string
+    output      string
+    external    int64
+    reproducible    bool
+    elf         bool
+    gzip        bool
+    // Timestamp -reproducible clamps mtimes to: SOURCE_DATE_EPOCH, or 0 if not
+    // set. -1 without -reproducible.
+    epoch       int64
+    // Executable (or base container, for delta).
     executable  string
     prefix      string
+    mounts      mountFlags
     paths       []string
+    // MIME type overrides loaded from mimefile, by extension (".ext") or
+    // bundle path pattern.
+    mimetypes   map[string]string
+    // Per-object tags loaded from tagfile, indexed by bundle path.
+    tags        map[string]map[string]string
 }
 
-func parseArgs() (a Args) {
+func parseArgs(cmd string, argv []string) (a Args) {
+    fs := flag.NewFlagSet(cmd, flag.ExitOnError)
     cphelp := "add asset paths as sub-directories (rather than merge all contained files and directories across asset paths under one directory)."
     dthelp := "produce detached asset container."
     dbhelp := "enable Caviar's debug mode."
     pfhelp := "custom path prefix for asset root."
-    flag.BoolVar(&a.cherrypick, "cherrypick", false, cphelp)
-    flag.BoolVar(&a.detached, "detached", false, dthelp)
-    flag.BoolVar(&a.debug, "debug", false, dbhelp)
-    flag.StringVar(&a.prefix, "prefix", "", pfhelp)
+    mthelp := "record extended metadata (nanosecond mtimes, ownership and xattrs)."
+    mmhelp := "JSON file overriding detected MIME types, by extension or bundle path pattern ({\".ext\": \"type\", \"path/*.x\": \"type\"})."
+    tghelp := "JSON sidecar file with per-object tags ({\"path/in/bundle\": {\"key\": \"value\"}})."
+    ophelp := "output file (defaults to modifying EXECUTABLE in place)."
+    dohelp := "output file for the patch container."
+    rphelp := "produce byte-identical output across builds of the same tree (mtimes are clamped to $SOURCE_DATE_EPOCH, or 0 if not set)."
+    elhelp := "embed the container in a dedicated ELF section rather than append it (requires objcopy)."
+    gzhelp := "store precompressed gzip variants of compressible files for caviar.FileServer."
+    mnhelp := "make the bundle subtree SOURCE also show up at the absolute path TARGET (SOURCE:TARGET, repeatable)."
+    exhelp := "files larger than this many bytes are read from the container on demand instead of being loaded to RAM (0 disables)."
+    if cmd != "strip" {
+        fs.BoolVar(&a.cherrypick, "cherrypick", false, cphelp)
+        fs.BoolVar(&a.debug, "debug", false, dbhelp)
+        fs.StringVar(&a.prefix, "prefix", "", pfhelp)
+        fs.BoolVar(&a.meta, "meta", false, mthelp)
+        fs.StringVar(&a.tagfile, "tags", "", tghelp)
+        fs.StringVar(&a.mimefile, "mimetypes", "", mmhelp)
+        fs.Int64Var(&a.external, "external", 0, exhelp)
+        fs.BoolVar(&a.reproducible, "reproducible", false, rphelp)
+        fs.BoolVar(&a.gzip, "gzip", false, gzhelp)
+    }
+    if cmd != "delta" && cmd != "strip" {
+        fs.BoolVar(&a.detached, "detached", false, dthelp)
+        fs.BoolVar(&a.elf, "elf", false, elhelp)
+        fs.Var(&a.mounts, "mount", mnhelp)
+    }
+    if cmd == "delta" {
+        fs.StringVar(&a.output, "o", "", dohelp)
+    } else {
+        fs.StringVar(&a.output, "o", "", ophelp)
+    }
     // TODO: extraction mode
-    flag.Parse()
+    positional := parseFlags(fs, argv)
+
+    minargs := 2
+    if cmd == "strip" { minargs = 1 }
 
-    if len(flag.Args()) < 2 {
+    if len(positional) < minargs || (cmd == "strip" && len(positional) > 1) ||
+        (cmd == "delta" && a.output == "") {
         fmt.Println("Cavundle is part of the Caviar resource packer for Go (http://github.com/mvillalba/caviar).")
         fmt.Println("Copyright © 2014 Martín Raúl Villalba <martin@martinvillalba.com>")
         fmt.Println("")
-        fmt.Printf("Usage: %s [OPTIONS] EXECUTABLE ASSET-PATH-1[...ASSET-PATH-N]\n", os.Args[0])
-        flag.PrintDefaults()
+        if cmd == "delta" {
+            fmt.Printf("Usage: %s delta [OPTIONS] BASE-CONTAINER ASSET-PATH-1[...ASSET-PATH-N] -o PATCH\n", os.Args[0])
+        } else if cmd == "strip" {
+            fmt.Printf("Usage: %s strip [OPTIONS] EXECUTABLE\n", os.Args[0])
+        } else {
+            fmt.Printf("Usage: %s [OPTIONS] EXECUTABLE ASSET-PATH-1[...ASSET-PATH-N]\n", os.Args[0])
+            fmt.Printf("       %s delta [OPTIONS] BASE-CONTAINER ASSET-PATH-1[...ASSET-PATH-N] -o PATCH\n", os.Args[0])
+            fmt.Printf("       %s strip [OPTIONS] EXECUTABLE\n", os.Args[0])
+        }
+        fs.PrintDefaults()
         os.Exit(1)
     }
 
-    a.executable = flag.Args()[0]
-    for _, path := range flag.Args()[1:] {
+    a.executable = positional[0]
+    for _, path := range positional[1:] {
         path, err := filepath.Abs(path)
         if err != nil { log.Fatal(err) }
         a.paths = append(a.paths, path)
     }
 
+    if a.output == "" { a.output = a.executable }
+
+    if a.detached && a.elf {
+        log.Fatal(errors.New("The -detached and -elf options are mutually exclusive."))
+    }
+
+    a.epoch = -1
+    if a.reproducible {
+        epoch, err := sourceDateEpoch()
+        if err != nil { log.Fatal(err) }
+        a.epoch = epoch
+    }
+
+    if a.tagfile != "" {
+        data, err := ioutil.ReadFile(a.tagfile)
+        if err != nil { log.Fatal(err) }
+        err = json.Unmarshal(data, &a.tags)
+        if err != nil { log.Fatal(errors.New("Invalid tag file: " + err.Error())) }
+    }
+
+    if a.mimefile != "" {
+        data, err := ioutil.ReadFile(a.mimefile)
+        if err != nil { log.Fatal(err) }
+        err = json.Unmarshal(data, &a.mimetypes)
+        if err != nil { log.Fatal(errors.New("Invalid MIME type file: " + err.Error())) }
+        for key := range a.mimetypes {
+            if _, err := path.Match(key, ""); err != nil {
+                log.Fatal(errors.New("Invalid MIME type pattern: " + key))
+            }
+        }
+    }
+
     return a
 }
 
+// Repeatable -mount SOURCE:TARGET flag.
+type mountFlags []caviar.Mount
+
+func (m *mountFlags) String() string {
+    var list []string
+    for _, mount := range *m { list = append(list, mount.Source + ":" + mount.Target) }
+    return strings.Join(list, ",")
+}
+
+func (m *mountFlags) Set(value string) error {
+    i := strings.Index(value, ":")
+    if i == -1 { return errors.New("expected SOURCE:TARGET") }
+
+    source, target := path.Clean(value[:i]), value[i+1:]
+    if !filepath.IsAbs(target) { return errors.New("mount target must be an absolute path") }
+
+    *m = append(*m, caviar.Mount{ Source: source, Target: target })
+    return nil
+}
+
+// Parse flags, allowing them to be interspersed with positional arguments.
+func parseFlags(fs *flag.FlagSet, argv []string) (positional []string) {
+    for {
+        fs.Parse(argv)
+        argv = fs.Args()
+        if len(argv) == 0 { return positional }
+        positional = append(positional, argv[0])
+        argv = argv[1:]
+    }
+}
+
+// Record extended metadata for an object.
+func processMeta(obj *caviar.Object, entry os.FileInfo, entrypath string) error {
+    obj.ModTimeNsec = int64(entry.ModTime().Nanosecond())
+    obj.Uid, obj.Gid = fileOwner(entry)
+
+    xattrs, err := fileXattrs(entrypath)
+    if err != nil { return err }
+    obj.Xattrs = xattrs
+
+    return nil
+}
+
+// Determine a file's MIME type given its bundle path: from the overrides in
+// the -mimetypes file if any matches (patterns take precedence over
+// extensions), and failing that, from the extension or contents.
+func mimeType(rel string, payload []byte, args Args) string {
+    var keys []string
+    for key := range args.mimetypes { keys = append(keys, key) }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        if isExtensionKey(key) { continue }
+        if ok, _ := path.Match(key, rel); ok { return args.mimetypes[key] }
+    }
+    ext := strings.ToLower(path.Ext(rel))
+    if mtype, ok := args.mimetypes[ext]; ok && isExtensionKey(ext) { return mtype }
+
+    return detectMimeType(rel, payload)
+}
+
+// Report whether a -mimetypes key is an extension (i.e. “.css”) rather than a
+// bundle path pattern (i.e. “.well-known/*”).
+func isExtensionKey(key string) bool {
+    return strings.HasPrefix(key, ".") && !strings.ContainsAny(key, "/*?[\\")
+}
+
+// Guess a file's MIME type from its extension and failing that, from its
+// contents.
+func detectMimeType(name string, payload []byte) string {
+    mtype := mime.TypeByExtension(path.Ext(name))
+    if mtype != "" || len(payload) == 0 { return mtype }
+    return http.DetectContentType(payload)
+}
+
+// Record the SHA-256 hash of a file's contents, and its fingerprint (a prefix
+// of the former).
+func processHash(obj *caviar.Object, payload []byte) {
+    sum := sha256.Sum256(payload)
+    obj.Sha256 = hex.EncodeToString(sum[:])
+    obj.Fingerprint = obj.Sha256[:FINGERPRINT_LENGTH]
+}
+
+// Attach user-supplied tags (if any) to an object.
+func processTags(obj *caviar.Object, rel string, args Args) {
+    tags, ok := args.tags[rel]
+    if !ok { return }
+
+    keys := make([]string, 0, len(tags))
+    for k := range tags { keys = append(keys, k) }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        obj.Tags = append(obj.Tags, caviar.Tag{ Key: k, Value: tags[k] })
+    }
+}
+
+// Payload holds a bundle's raw asset data: the in-memory assets (Assets.bin)
+// and the external ones read from the container on demand (External.bin).
+type Payload struct {
+    assets      bytes.Buffer
+    external    bytes.Buffer
+}
+
+// Append an object's data to the relevant buffer and set its offset.
+func (p *Payload) add(obj *caviar.Object, data []byte) {
+    buf := &p.assets
+    if obj.External { buf = &p.external }
+    obj.Offset = int64(buf.Len())
+    buf.Write(data)
+}
 
-func processDirectory(obj *caviar.Object, dir string, buf *bytes.Buffer) error {
+// Append an object's gzip variant to the payload its data lives in.
+func (p *Payload) addGzip(obj *caviar.Object, data []byte) {
+    buf := &p.assets
+    if obj.External { buf = &p.external }
+    obj.GzipOffset = int64(buf.Len())
+    obj.GzipSize = int64(len(data))
+    obj.GzipChecksum = crc32.ChecksumIEEE(data)
+    buf.Write(data)
+}
+
+func processDirectory(obj *caviar.Object, dir string, rel string, payloads *Payload, args Args) error {
     dirlist, err := ioutil.ReadDir(dir)
     if err != nil { return err }
     for _, entry := range dirlist {
         entrypath := path.Join(dir, entry.Name())
+        entryrel := path.Join(rel, entry.Name())
+        var payload []byte
 
         nobj := new(caviar.Object)
         nobj.Name = entry.Name()
@@ -79,36 +302,51 @@ func processDirectory(obj *caviar.Object, dir string, buf *bytes.Buffer) error {
             nobj.Offset = 0
             nobj.Checksum = 0
 
-            err := processDirectory(nobj, entrypath, buf)
+            err := processDirectory(nobj, entrypath, entryrel, payloads, args)
             if err != nil { return err }
         } else {
             if entry.Size() == 0 {
                 nobj.Size = 0
                 nobj.Offset = 0
                 nobj.Checksum = 0
+                processHash(nobj, nil)
+                nobj.MimeType = mimeType(entryrel, nil, args)
             } else {
                 nobj.Size = entry.Size()
-                nobj.Offset = int64(buf.Len())
+                nobj.External = args.external > 0 && nobj.Size > args.external
 
-                payload, err := ioutil.ReadFile(entrypath)
+                payload, err = ioutil.ReadFile(entrypath)
                 if err != nil { return err }
 
-                buf.Write(payload)
+                payloads.add(nobj, payload)
                 h := crc32.NewIEEE()
                 h.Write(payload)
                 nobj.Checksum = h.Sum32()
+                processHash(nobj, payload)
+                nobj.MimeType = mimeType(entryrel, payload, args)
+
+                if args.gzip {
+                    err = processGzip(nobj, payload, payloads)
+                    if err != nil { return err }
+                }
             }
         }
 
+        if args.meta {
+            err := processMeta(nobj, entry, entrypath)
+            if err != nil { return err }
+        }
+        processTags(nobj, entryrel, args)
+
         obj.Objects = append(obj.Objects, *nobj)
     }
 
     return nil
 }
 
-func processAssets(args Args) (*caviar.Manifest, []byte, error) {
+func processAssets(args Args) (*caviar.Manifest, *Payload, error) {
     // Init
-    buf := new(bytes.Buffer)
+    payloads := new(Payload)
     manifest := new(caviar.Manifest)
     manifest.Magic = caviar.MANIFEST_MAGIC
     manifest.Comment = MANIFEST_COMMENT
@@ -116,69 +354,112 @@ func processAssets(args Args) (*caviar.Manifest, []byte, error) {
     manifest.ObjectRoot.ModeBits = os.ModeDir | 0755;
     manifest.Options.Debug = args.debug
     manifest.Options.CustomPrefix = args.prefix
+    manifest.Options.Mounts = args.mounts
     manifest.Options.ExtractionMode = caviar.EXTRACT_MEMORY
+    manifest.Options.ExtendedMeta = args.meta
+    manifest.Options.ExternalThreshold = args.external
 
     // Process each asset path individually
     for _, assetpath := range args.paths {
         if args.cherrypick { assetpath = filepath.Dir(assetpath) }
-        err := processDirectory(&manifest.ObjectRoot, assetpath, buf)
+        err := processDirectory(&manifest.ObjectRoot, assetpath, "", payloads, args)
         if err != nil { return nil, nil, err }
     }
 
-    return manifest, buf.Bytes(), nil
-}
+    if args.reproducible { normalizeObject(&manifest.ObjectRoot, args) }
 
-func main() {
-    args := parseArgs()
+    return manifest, payloads, nil
+}
 
-    // Container
+// Serialize a manifest and its asset payload into a ZIP container.
+func buildContainer(manifest *caviar.Manifest, payloads *Payload, args Args) (*bytes.Buffer, error) {
     buf := new(bytes.Buffer)
     zw := zip.NewWriter(buf)
+    modified := containerTime(args)
 
-    // Pack assets
-    manifest, assets, err := processAssets(args)
-    if err != nil { log.Fatal(err) }
+    assets := payloads.assets.Bytes()
+    manifest.Digest = caviar.Digest(manifest, assets)
 
-    f, _ := zw.Create("Manifest.gob")
+    f, err := zw.CreateHeader(&zip.FileHeader{ Name: "Manifest.gob", Method: zip.Deflate, Modified: modified })
+    if err != nil { return nil, err }
     enc := gob.NewEncoder(f)
     err = enc.Encode(*manifest)
-    if err != nil { log.Fatal(err) }
+    if err != nil { return nil, err }
 
-    f, _ = zw.Create("Assets.bin")
+    f, err = zw.CreateHeader(&zip.FileHeader{ Name: "Assets.bin", Method: zip.Deflate, Modified: modified })
+    if err != nil { return nil, err }
     _, err = f.Write(assets)
-    if err != nil { log.Fatal(err) }
+    if err != nil { return nil, err }
+
+    // External payload is stored rather than deflated so it can be read in
+    // place at runtime.
+    if payloads.external.Len() != 0 {
+        f, err = zw.CreateHeader(&zip.FileHeader{ Name: "External.bin", Method: zip.Store, Modified: modified })
+        if err != nil { return nil, err }
+        _, err = f.Write(payloads.external.Bytes())
+        if err != nil { return nil, err }
+    }
 
     // Clean up
     err = zw.Close()
-    if err != nil {
-        log.Fatal(err)
+    if err != nil { return nil, err }
+
+    return buf, nil
+}
+
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "delta" {
+        delta(parseArgs("delta", os.Args[2:]))
+        return
     }
 
-    // Dump buffer
-    fpath, err := filepath.Abs(args.executable)
+    if len(os.Args) > 1 && os.Args[1] == "strip" {
+        strip(parseArgs("strip", os.Args[2:]))
+        return
+    }
+
+    args := parseArgs(os.Args[0], os.Args[1:])
+
+    // Pack assets
+    manifest, payloads, err := processAssets(args)
+    if err != nil { log.Fatal(err) }
+
+    // Container
+    buf, err := buildContainer(manifest, payloads, args)
     if err != nil { log.Fatal(err) }
 
-    var fp *os.File
+    // Dump buffer
     if args.detached {
-        fpath = caviar.DetachedName(fpath)
-        fp, err = os.OpenFile(fpath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0664)
-    } else {
-        fp, err = os.OpenFile(fpath, os.O_WRONLY | os.O_APPEND, 0664)
+        err = writeAtomic(caviar.DetachedName(args.output), 0644, func(tmp string) error {
+            return ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+        })
+        if err != nil { log.Fatal(err) }
+        return
     }
+
+    fi, err := os.Stat(args.executable)
     if err != nil { log.Fatal(err) }
 
-    buf.WriteTo(fp)
+    err = writeAtomic(args.output, fi.Mode(), func(tmp string) error {
+        // Start off with a bare copy of the executable, so running cavundle
+        // again replaces the container rather than stacking a new one.
+        err := copyExecutable(tmp, args.executable)
+        if err != nil { return err }
 
-    fp.Sync()
-    fp.Close()
+        if args.elf { return embedELF(tmp, buf) }
 
-    // Re-align container
-    if args.detached { return }
+        fp, err := os.OpenFile(tmp, os.O_WRONLY | os.O_APPEND, 0)
+        if err != nil { return err }
+        _, err = buf.WriteTo(fp)
+        fp.Close()
+        if err != nil { return err }
 
-    errprefix := "Zip align error: "
-    cmd := exec.Command("zip", "-A", fpath)
-    err = cmd.Start()
-    if err != nil { log.Fatal(errors.New(errprefix + err.Error())) }
-    err = cmd.Wait()
-    if err != nil { log.Fatal(errors.New(errprefix + err.Error())) }
+        // Re-align container
+        errprefix := "Zip align error: "
+        cmd := exec.Command("zip", "-A", tmp)
+        err = cmd.Run()
+        if err != nil { return errors.New(errprefix + err.Error()) }
+        return nil
+    })
+    if err != nil { log.Fatal(err) }
 }
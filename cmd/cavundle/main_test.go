@@ -0,0 +1,74 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestMimeType(t *testing.T) {
+    args := Args{ mimetypes: map[string]string{
+        ".css":             "text/x-custom-css",
+        ".well-known/*":    "application/json",
+        "docs/*.txt":       "text/markdown",
+    } }
+
+    for rel, want := range map[string]string{
+        "site.css":                     "text/x-custom-css",
+        "theme/site.CSS":               "text/x-custom-css",
+        ".well-known/security":         "application/json",
+        "docs/readme.txt":              "text/markdown",
+        "notes.txt":                    "text/plain; charset=utf-8",
+    } {
+        got := mimeType(rel, []byte("hello"), args)
+        if got != want { t.Errorf("%v: got %v, want %v.", rel, got, want) }
+    }
+}
+
+func TestMimeTypesFile(t *testing.T) {
+    dir := t.TempDir()
+    files := map[string]string{
+        ".well-known/security.txt":     "application/x-well-known",
+        ".well-known/sub/notes.txt":    "text/plain; charset=utf-8",
+        ".config/app.json":             "application/x-config",
+        ".npmrc":                       "text/x-rc",
+        "docs/.htaccess":               "text/x-htaccess",
+        "site.css":                     "text/x-custom-css",
+    }
+    for name := range files {
+        p := filepath.Join(dir, filepath.FromSlash(name))
+        err := os.MkdirAll(filepath.Dir(p), 0755)
+        if err != nil { t.Fatal(err) }
+        err = ioutil.WriteFile(p, []byte("hello"), 0644)
+        if err != nil { t.Fatal(err) }
+    }
+
+    // Dotted keys are extensions unless they look like path patterns.
+    mimefile := filepath.Join(t.TempDir(), "mimetypes.json")
+    err := ioutil.WriteFile(mimefile, []byte(`{
+        ".css":             "text/x-custom-css",
+        ".htaccess":        "text/x-htaccess",
+        ".well-known/*":    "application/x-well-known",
+        ".config/*.json":   "application/x-config",
+        ".*rc":             "text/x-rc"
+    }`), 0644)
+    if err != nil { t.Fatal(err) }
+
+    args := parseArgs("cavundle", []string{ "-mimetypes", mimefile, "-detached", "program", dir })
+    manifest, _, err := processAssets(args)
+    if err != nil { t.Fatal(err) }
+
+    for name, want := range files {
+        obj := &manifest.ObjectRoot
+        for _, segment := range strings.Split(name, "/") {
+            for i := 0; i < len(obj.Objects); i++ {
+                if obj.Objects[i].Name == segment { obj = &obj.Objects[i] }
+            }
+        }
+        if obj.Name != path.Base(name) { t.Fatalf("%v not bundled.", name) }
+        if obj.MimeType != want { t.Errorf("%v: got %v, want %v.", name, obj.MimeType, want) }
+    }
+}
@@ -0,0 +1,48 @@
+// +build linux
+
+package main
+
+import (
+    "os"
+    "sort"
+    "strings"
+    "syscall"
+    "github.com/mvillalba/caviar"
+)
+
+// Return the numeric owner and group IDs of a file.
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+    st, ok := fi.Sys().(*syscall.Stat_t)
+    if !ok { return 0, 0 }
+    return int(st.Uid), int(st.Gid)
+}
+
+// Return all extended attributes of a file, sorted by name.
+func fileXattrs(fpath string) ([]caviar.Xattr, error) {
+    size, err := syscall.Listxattr(fpath, nil)
+    if err == syscall.ENOTSUP { return nil, nil }
+    if err != nil { return nil, err }
+    if size == 0 { return nil, nil }
+
+    buf := make([]byte, size)
+    size, err = syscall.Listxattr(fpath, buf)
+    if err != nil { return nil, err }
+
+    var names []string
+    for _, name := range strings.Split(string(buf[:size]), "\x00") {
+        if name != "" { names = append(names, name) }
+    }
+    sort.Strings(names)
+
+    var xattrs []caviar.Xattr
+    for _, name := range names {
+        vsize, err := syscall.Getxattr(fpath, name, nil)
+        if err != nil { return nil, err }
+        value := make([]byte, vsize)
+        vsize, err = syscall.Getxattr(fpath, name, value)
+        if err != nil { return nil, err }
+        xattrs = append(xattrs, caviar.Xattr{ Name: name, Value: value[:vsize] })
+    }
+
+    return xattrs, nil
+}
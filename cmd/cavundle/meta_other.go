@@ -0,0 +1,18 @@
+// +build !linux
+
+package main
+
+import (
+    "os"
+    "github.com/mvillalba/caviar"
+)
+
+// Ownership is not recorded on this platform.
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+    return 0, 0
+}
+
+// Extended attributes are not recorded on this platform.
+func fileXattrs(fpath string) ([]caviar.Xattr, error) {
+    return nil, nil
+}
@@ -0,0 +1,56 @@
+// reproducible.go implements the -reproducible mode, which strips everything
+// from a bundle that would make it differ across builds of the same tree.
+
+package main
+
+import (
+    "errors"
+    "os"
+    "sort"
+    "strconv"
+    "time"
+    "github.com/mvillalba/caviar"
+)
+
+// Parse the SOURCE_DATE_EPOCH environment variable (see
+// https://reproducible-builds.org/specs/source-date-epoch/). Returns 0 if it's
+// not set, so that every mtime is fixed rather than taken from the tree.
+func sourceDateEpoch() (int64, error) {
+    v := os.Getenv("SOURCE_DATE_EPOCH")
+    if v == "" { return 0, nil }
+    epoch, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || epoch < 0 {
+        return -1, errors.New("Invalid SOURCE_DATE_EPOCH: " + v)
+    }
+    return epoch, nil
+}
+
+// Timestamp to use for ZIP entries. The zero time makes the ZIP writer fall
+// back to the MS-DOS epoch.
+func containerTime(args Args) time.Time {
+    if !args.reproducible || args.epoch <= 0 { return time.Time{} }
+    return time.Unix(args.epoch, 0).UTC()
+}
+
+// Recursively normalize an object: sort its children by name, clamp its
+// modification time to args.epoch (dropping nanoseconds), reset permission
+// bits to 0755 for directories and executables, 0644 otherwise, and drop
+// ownership and extended attributes (which depend on who builds it, and where).
+func normalizeObject(obj *caviar.Object, args Args) {
+    if obj.ModTime >= args.epoch { obj.ModTime = args.epoch }
+    obj.ModTimeNsec = 0
+
+    perm := os.FileMode(0644)
+    if obj.ModeBits.IsDir() || obj.ModeBits & 0111 != 0 { perm = 0755 }
+    obj.ModeBits = obj.ModeBits &^ os.ModePerm | perm
+    obj.Uid = 0
+    obj.Gid = 0
+    obj.Xattrs = nil
+
+    sort.SliceStable(obj.Objects, func(i, j int) bool {
+        return obj.Objects[i].Name < obj.Objects[j].Name
+    })
+    for i := 0; i < len(obj.Objects); i++ {
+        normalizeObject(&obj.Objects[i], args)
+    }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// Lay out the same asset tree under dir, with every mtime set to modtime.
+func writeTree(t *testing.T, dir string, modtime time.Time) {
+    files := map[string]string{
+        "index.html":       "<html></html>",
+        "css/site.css":     "body { margin: 0 }",
+        "js/app.js":        "console.log('hi')",
+        "js/vendor/lib.js": "var lib = {}",
+        "empty.txt":        "",
+    }
+    for name, data := range files {
+        p := filepath.Join(dir, filepath.FromSlash(name))
+        err := os.MkdirAll(filepath.Dir(p), 0755)
+        if err != nil { t.Fatal(err) }
+        err = ioutil.WriteFile(p, []byte(data), 0644)
+        if err != nil { t.Fatal(err) }
+    }
+
+    err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+        if err != nil { return err }
+        return os.Chtimes(p, modtime, modtime)
+    })
+    if err != nil { t.Fatal(err) }
+}
+
+// Bundle a tree the way cavundle -reproducible would (plus any other options)
+// and return the container.
+func bundleTree(t *testing.T, dir string, options ...string) []byte {
+    argv := append([]string{ "-reproducible", "-detached" }, options...)
+    args := parseArgs("cavundle", append(argv, "program", dir))
+    manifest, payloads, err := processAssets(args)
+    if err != nil { t.Fatal(err) }
+    buf, err := buildContainer(manifest, payloads, args)
+    if err != nil { t.Fatal(err) }
+    return buf.Bytes()
+}
+
+// Set every mtime in a tree to now, as a fresh checkout or build would.
+func touchTree(t *testing.T, dir string) {
+    now := time.Now()
+    err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+        if err != nil { return err }
+        return os.Chtimes(p, now, now)
+    })
+    if err != nil { t.Fatal(err) }
+}
+
+func TestReproducible(t *testing.T) {
+    t.Setenv("SOURCE_DATE_EPOCH", "")
+    os.Unsetenv("SOURCE_DATE_EPOCH")
+
+    for _, options := range [][]string{ nil, { "-meta" } } {
+        a := filepath.Join(t.TempDir(), "a")
+        b := filepath.Join(t.TempDir(), "elsewhere", "b")
+        writeTree(t, a, time.Unix(1500000000, 0))
+        writeTree(t, b, time.Unix(1600000000, 123456789))
+
+        first := bundleTree(t, a, options...)
+        touchTree(t, a)
+        if !bytes.Equal(first, bundleTree(t, a, options...)) {
+            t.Fatalf("Bundles (%v) differ after touching the tree.", options)
+        }
+        if !bytes.Equal(first, bundleTree(t, b, options...)) {
+            t.Fatalf("Bundles (%v) of the same tree differ.", options)
+        }
+    }
+}
+
+func TestReproducibleEpoch(t *testing.T) {
+    t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+
+    a := filepath.Join(t.TempDir(), "a")
+    b := filepath.Join(t.TempDir(), "elsewhere", "b")
+    writeTree(t, a, time.Unix(1500000000, 0))
+    writeTree(t, b, time.Unix(1600000000, 123456789))
+
+    if !bytes.Equal(bundleTree(t, a, "-meta"), bundleTree(t, b, "-meta")) {
+        t.Fatal("Bundles of the same tree differ.")
+    }
+}
@@ -0,0 +1,106 @@
+// strip.go implements detecting and removing existing containers from
+// executables, so bundling is idempotent, as well as the “strip” command.
+
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "debug/elf"
+    "encoding/binary"
+    "io/ioutil"
+    "log"
+    "os"
+    "github.com/mvillalba/caviar"
+)
+
+// Restore the bare executable named by args.executable.
+func strip(args Args) {
+    fi, err := os.Stat(args.executable)
+    if err != nil { log.Fatal(err) }
+
+    err = writeAtomic(args.output, fi.Mode(), func(tmp string) error {
+        return copyExecutable(tmp, args.executable)
+    })
+    if err != nil { log.Fatal(err) }
+}
+
+// Copy an executable, minus any containers it carries.
+func copyExecutable(dst, src string) error {
+    data, err := ioutil.ReadFile(src)
+    if err != nil { return err }
+
+    err = ioutil.WriteFile(dst, data, 0600)
+    if err != nil { return err }
+
+    return stripContainers(dst)
+}
+
+// Remove all containers from an executable, whether embedded in an ELF section
+// or appended to the file (possibly more than once, by older versions of
+// cavundle).
+func stripContainers(fpath string) error {
+    f, err := elf.Open(fpath)
+    if err == nil {
+        section := f.Section(caviar.ELF_SECTION)
+        f.Close()
+        if section != nil {
+            err = objcopy(fpath, "--remove-section", caviar.ELF_SECTION)
+            if err != nil { return err }
+        }
+    }
+
+    data, err := ioutil.ReadFile(fpath)
+    if err != nil { return err }
+
+    size := int64(len(data))
+    for {
+        start, ok := appendedContainer(data[:size])
+        if !ok { break }
+        size = start
+    }
+
+    if size == int64(len(data)) { return nil }
+    return os.Truncate(fpath, size)
+}
+
+// Find a container appended to data. Returns the offset it starts at.
+func appendedContainer(data []byte) (start int64, ok bool) {
+    r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+    if err != nil { return 0, false }
+
+    // The ZIP must run up to the very end of the data
+    eocd := len(data) - 22 - len(r.Comment)
+    if eocd < 0 || string(data[eocd:eocd+4]) != "PK\x05\x06" { return 0, false }
+
+    // And it must be ours
+    found := false
+    start = int64(len(data))
+    for _, f := range r.File {
+        if f.Name == "Manifest.gob" { found = true }
+        offset, ok := localHeaderOffset(data, f)
+        if !ok { return 0, false }
+        if offset < start { start = offset }
+    }
+
+    return start, found
+}
+
+// Find the offset of a ZIP entry's local file header, working backwards from
+// the offset of its data.
+func localHeaderOffset(data []byte, f *zip.File) (int64, bool) {
+    dataoff, err := f.DataOffset()
+    if err != nil { return 0, false }
+
+    namelen := int64(len(f.Name))
+    for p := dataoff - 30 - namelen; p >= 0 && p >= dataoff - 30 - namelen - 0xffff; p-- {
+        if string(data[p:p+4]) != "PK\x03\x04" { continue }
+        n := int64(binary.LittleEndian.Uint16(data[p+26:]))
+        e := int64(binary.LittleEndian.Uint16(data[p+28:]))
+        if n == namelen && p + 30 + n + e == dataoff && string(data[p+30:p+30+n]) == f.Name {
+            return p, true
+        }
+    }
+
+    return 0, false
+}
@@ -0,0 +1,59 @@
+// cwd.go implements a virtual working directory, which may point inside the
+// bundle.
+
+package caviar
+
+import (
+    "os"
+    "path/filepath"
+    "syscall"
+)
+
+// Chdir mimicks os.Chdir(), except that dir may be a directory inside the
+// bundle. It becomes the virtual working directory, against which relative
+// paths given to Open, Stat, Glob, Walk and friends are resolved. If dir also
+// exists on disk, the process' working directory is changed as well, so the os
+// package and child processes agree. Code that mixes caviar.Chdir() and
+// os.Chdir() will get confused.
+func Chdir(dir string) error {
+    abs, err := absPath(dir)
+    if err != nil { return pathError("chdir", dir, err) }
+
+    fi, err := Stat(abs)
+    if err != nil { return pathError("chdir", dir, os.ErrNotExist) }
+    if !fi.IsDir() { return pathError("chdir", dir, syscall.ENOTDIR) }
+
+    if nfi, err := os.Stat(abs); err == nil && nfi.IsDir() {
+        err = os.Chdir(abs)
+        if err != nil { return err }
+    }
+
+    state.cwd = abs
+    return nil
+}
+
+// Getwd mimicks os.Getwd(), returning the virtual working directory if one was
+// set through Chdir().
+func Getwd() (string, error) {
+    if state.cwd != "" { return state.cwd, nil }
+    return os.Getwd()
+}
+
+// Return name as a clean absolute path. Relative paths are resolved against
+// the virtual working directory, if set.
+func absPath(name string) (string, error) {
+    if filepath.IsAbs(name) { return filepath.Clean(name), nil }
+    if state.cwd != "" { return filepath.Join(state.cwd, name), nil }
+
+    abs, err := filepath.Abs(name)
+    if err != nil { return "", debug(err) }
+    return abs, nil
+}
+
+// Return the path to hand over to the os package for name. Relative paths are
+// rewritten while the virtual working directory is set, as it may differ from
+// the process'.
+func nativePath(name string) string {
+    if state.cwd == "" || filepath.IsAbs(name) { return name }
+    return filepath.Join(state.cwd, name)
+}
@@ -0,0 +1,214 @@
+// debughandler.go implements an HTTP handler for inspecting what the running
+// process loaded, in the spirit of expvar and net/http/pprof.
+
+package caviar
+
+import (
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "net/http"
+    "path"
+    "strings"
+    "time"
+)
+
+// Summary of the loaded bundle, as served by DebugHandler.
+type debugInfo struct {
+    Ready       bool            `json:"ready"`
+    Error       string          `json:"error,omitempty"`
+    Source      string          `json:"source,omitempty"`
+    Container   string          `json:"container,omitempty"`
+    Prefix      string          `json:"prefix,omitempty"`
+    Digest      string          `json:"digest,omitempty"`
+    Patches     []debugPatch    `json:"patches,omitempty"`
+    Magic       string          `json:"magic,omitempty"`
+    Comment     string          `json:"comment,omitempty"`
+    Options     *BundleOptions  `json:"options,omitempty"`
+    Mounts      []Mount         `json:"mounts,omitempty"`
+    Overlay     bool            `json:"overlay"`
+    // Whether everything loaded has been checked and found intact.
+    Verified    bool            `json:"verified"`
+    Checks      *debugChecks    `json:"checks,omitempty"`
+    PayloadSize int64           `json:"payloadSize"`
+    Root        *debugObject    `json:"root,omitempty"`
+}
+
+// What has been checked so far: the manifests and in-RAM payloads of the base
+// bundle and patches (by Init() or ApplyPatch()), and external objects (when
+// first opened, or by Verify()).
+type debugChecks struct {
+    Manifest    bool            `json:"manifest"`
+    External    int             `json:"external"`
+    Checked     int             `json:"checked"`
+    Failed      []string        `json:"failed,omitempty"`
+}
+
+type debugPatch struct {
+    File        string          `json:"file"`
+    Digest      string          `json:"digest"`
+}
+
+type debugObject struct {
+    Name        string          `json:"name"`
+    Path        string          `json:"path"`
+    Mode        string          `json:"mode"`
+    Size        int64           `json:"size"`
+    Checksum    string          `json:"checksum,omitempty"`
+    ModTime     time.Time       `json:"modTime"`
+    MimeType    string          `json:"mimeType,omitempty"`
+    Fingerprint string          `json:"fingerprint,omitempty"`
+    GzipSize    int64           `json:"gzipSize,omitempty"`
+    External    bool            `json:"external,omitempty"`
+    // Outcome of checking external objects: "pending", "ok" or the error.
+    Check       string          `json:"check,omitempty"`
+    Objects     []*debugObject  `json:"objects,omitempty"`
+}
+
+// DebugHandler returns a handler serving what the running process loaded: the
+// bundle's source (attached, ELF section, detached or downloaded container,
+// plus patches), its manifest comment and options, verification status and
+// object tree with sizes, checksums and modification times. Mount it wherever
+// you like, i.e.
+//
+//     http.Handle("/debug/caviar/", caviar.DebugHandler())
+//
+// Requests are answered with an HTML page, or JSON if the path ends in “json”
+// or the query string has format=json. Paths ending in “health” answer 200 OK
+// once Caviar is ready and 503 Service Unavailable otherwise, for readiness
+// probes.
+func DebugHandler() http.Handler {
+    return http.HandlerFunc(serveDebug)
+}
+
+func serveDebug(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "no-store")
+    base := path.Base(r.URL.Path)
+
+    if base == "health" {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        if !state.ready {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            msg := "not ready"
+            if state.err != nil { msg += ": " + state.err.Error() }
+            fmt.Fprintln(w, msg)
+            return
+        }
+        fmt.Fprintln(w, "ok")
+        return
+    }
+
+    info := newDebugInfo()
+
+    if base == "json" || r.URL.Query().Get("format") == "json" {
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        enc.Encode(info)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    err := debugTemplate.Execute(w, info)
+    if err != nil { debug(err) }
+}
+
+// Take a snapshot of the current state.
+func newDebugInfo() *debugInfo {
+    info := &debugInfo{ Ready: state.ready, Overlay: state.overlay != nil }
+    if state.err != nil { info.Error = state.err.Error() }
+    if !state.ready { return info }
+
+    info.Source = state.source
+    info.Container = state.kind
+    info.Prefix = state.prefix
+    info.Digest = state.digest
+    for i := 0; i < len(state.patches); i++ {
+        info.Patches = append(info.Patches, debugPatch{ state.patchfiles[i], state.patches[i] })
+    }
+    info.Magic = state.manifest.Magic
+    info.Comment = state.manifest.Comment
+    info.Options = &state.manifest.Options
+    info.Mounts = Mounts()
+    info.PayloadSize = PayloadSize()
+
+    v := &debugChecks{ Manifest: state.verified }
+    info.Root = newDebugObject(&state.manifest.ObjectRoot, ".", v)
+    info.Checks = v
+    info.Verified = v.Manifest && v.Checked == v.External && len(v.Failed) == 0
+
+    return info
+}
+
+// Describe an object and its children, tallying the outcome of checking
+// external ones in v.
+func newDebugObject(obj *Object, rel string, v *debugChecks) *debugObject {
+    d := &debugObject{
+        Name:           obj.Name,
+        Path:           rel,
+        Mode:           obj.ModeBits.String(),
+        Size:           obj.Size,
+        ModTime:        time.Unix(obj.ModTime, obj.ModTimeNsec).UTC(),
+        MimeType:       obj.MimeType,
+        Fingerprint:    obj.Fingerprint,
+        GzipSize:       obj.GzipSize,
+        External:       obj.External,
+    }
+    if !obj.ModeBits.IsDir() { d.Checksum = fmt.Sprintf("%08x", obj.Checksum) }
+
+    if obj.External {
+        v.External++
+        d.Check = "pending"
+        if checked, err := externalChecked(obj); checked {
+            v.Checked++
+            d.Check = "ok"
+            if err != nil {
+                v.Failed = append(v.Failed, rel)
+                d.Check = err.Error()
+            }
+        }
+    }
+
+    for i := 0; i < len(obj.Objects); i++ {
+        child := &obj.Objects[i]
+        d.Objects = append(d.Objects, newDebugObject(child, path.Join(rel, child.Name), v))
+    }
+    return d
+}
+
+// Flatten the object tree for the HTML page.
+func (d *debugObject) Flatten() []*debugObject {
+    list := []*debugObject{ d }
+    for _, child := range d.Objects { list = append(list, child.Flatten()...) }
+    return list
+}
+
+// Indentation for the HTML page.
+func (d *debugObject) Depth() string {
+    if d.Path == "." { return "" }
+    return strings.Repeat("  ", strings.Count(d.Path, "/") + 1)
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!doctype html>
+<meta name="viewport" content="width=device-width">
+<title>Caviar</title>
+<h1>Caviar</h1>
+{{if not .Ready}}<p><b>Not ready</b>{{if .Error}}: {{.Error}}{{end}}</p>{{else}}
+<table>
+<tr><th align=left>Source</th><td>{{.Source}} ({{.Container}})</td></tr>
+<tr><th align=left>Prefix</th><td>{{.Prefix}}</td></tr>
+<tr><th align=left>Digest</th><td>{{.Digest}}</td></tr>
+{{range .Patches}}<tr><th align=left>Patch</th><td>{{.File}} ({{.Digest}})</td></tr>
+{{end}}{{with .Checks}}<tr><th align=left>Verified</th><td>{{$.Verified}} (manifest {{.Manifest}}, {{.Checked}} of {{.External}} external objects checked{{range .Failed}}, {{.}} failed{{end}})</td></tr>{{end}}
+<tr><th align=left>Payload</th><td>{{.PayloadSize}} bytes in RAM</td></tr>
+<tr><th align=left>Overlay</th><td>{{.Overlay}}</td></tr>
+{{with .Options}}<tr><th align=left>Options</th><td>custom prefix {{printf "%q" .CustomPrefix}}, debug {{.Debug}}, extraction mode {{.ExtractionMode}}, external threshold {{.ExternalThreshold}}, extended metadata {{.ExtendedMeta}}</td></tr>{{end}}
+{{range .Mounts}}<tr><th align=left>Mount</th><td>{{.Source}} on {{.Target}}</td></tr>
+{{end}}</table>
+<pre>{{.Comment}}</pre>
+<h2>Objects</h2>
+<pre>
+{{range .Root.Flatten}}{{.Mode}} {{printf "%12d" .Size}} {{printf "%8s" .Checksum}} {{.ModTime.Format "2006-01-02 15:04:05"}} {{.Depth}}{{.Name}}{{if .External}} [external, {{.Check}}]{{end}}{{if .GzipSize}} [gzip {{.GzipSize}}]{{end}}
+{{end}}</pre>{{end}}
+<p><a href="?format=json">JSON</a></p>
+`))
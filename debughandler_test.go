@@ -0,0 +1,90 @@
+package caviar
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Fetch a page from DebugHandler().
+func testDebugGet(t *testing.T, path string) (*http.Response, string) {
+    srv := httptest.NewServer(DebugHandler())
+    defer srv.Close()
+    return testGetEncoded(t, srv.URL + path, "identity")
+}
+
+// Fetch and decode the JSON summary from DebugHandler().
+func testDebugInfo(t *testing.T) *debugInfo {
+    resp, body := testDebugGet(t, "/debug/caviar/json")
+    if resp.StatusCode != http.StatusOK { t.Fatalf("JSON GET got %v.", resp.Status) }
+    info := new(debugInfo)
+    err := json.Unmarshal([]byte(body), info)
+    if err != nil { t.Fatal(err) }
+    return info
+}
+
+func TestDebugHandlerVerified(t *testing.T) {
+    check := func(what string, verified bool, checked int, failed []string, ext string) {
+        info := testDebugInfo(t)
+        if !info.Ready || info.Checks == nil || !info.Checks.Manifest {
+            t.Fatalf("%v: JSON reported ready %v, checks %+v.", what, info.Ready, info.Checks)
+        }
+        if info.Verified != verified || info.Checks.External != 1 || info.Checks.Checked != checked || !reflect.DeepEqual(info.Checks.Failed, failed) {
+            t.Fatalf("%v: JSON reported verified %v, checks %+v.", what, info.Verified, info.Checks)
+        }
+        obj := info.Root
+        for _, name := range []string{ "ext", "app.js" } {
+            for _, child := range obj.Objects {
+                if child.Name == name { obj = child }
+            }
+        }
+        if obj.Path != "ext/app.js" || !strings.HasPrefix(obj.Check, ext) {
+            t.Fatalf("%v: JSON reported %v as %q.", what, obj.Path, obj.Check)
+        }
+    }
+
+    // External objects are only verified once opened.
+    testWithSite(t, nil, func(url string) {
+        check("Before opening", false, 0, nil, "pending")
+        _, err := testRead(state.prefix + "/ext/app.js")
+        if err != nil { t.Fatal(err) }
+        check("After opening", true, 1, nil, "ok")
+    })
+
+    testWithSite(t, nil, func(url string) {
+        err := Verify()
+        if err == nil { t.Fatal("Verify() passed a corrupt external object.") }
+        check("Corrupt", false, 1, []string{ "ext/app.js" }, "Checksum error")
+
+        resp, body := testDebugGet(t, "/debug/caviar/")
+        if resp.StatusCode != http.StatusOK || !strings.Contains(body, "ext/app.js failed") {
+            t.Fatalf("HTML GET got %v, body without the failed object.", resp.Status)
+        }
+    }, func(m *Manifest) { testObject(&m.ObjectRoot, "ext/app.js").Checksum ^= 1 })
+}
+
+func TestDebugHandlerHealth(t *testing.T) {
+    testWithSite(t, nil, func(url string) {
+        resp, body := testDebugGet(t, "/debug/caviar/health")
+        if resp.StatusCode != http.StatusOK || body != "ok\n" {
+            t.Fatalf("Health GET when ready got %v, %q.", resp.Status, body)
+        }
+    })
+
+    saved := state
+    state = caviarState{ err: errors.New("broken") }
+    defer func() { state = saved }()
+
+    resp, body := testDebugGet(t, "/debug/caviar/health")
+    if resp.StatusCode != http.StatusServiceUnavailable || body != "not ready: broken\n" {
+        t.Fatalf("Health GET when not ready got %v, %q.", resp.Status, body)
+    }
+    info := testDebugInfo(t)
+    if info.Ready || info.Verified || info.Error != "broken" {
+        t.Fatalf("JSON when not ready reported %+v.", info)
+    }
+}
@@ -0,0 +1,195 @@
+// +build linux
+
+// fd_linux.go implements OpenFd on top of memfd_create(2).
+
+package caviar
+
+import (
+    "bytes"
+    "container/list"
+    "io"
+    "os"
+    "runtime"
+    "strconv"
+    "sync"
+    "syscall"
+    "unsafe"
+)
+
+// memfd_create(2) flags and fcntl(2) sealing commands, which the syscall
+// package lacks.
+const (
+    mfdCloexec      = 0x1
+    mfdAllowSealing = 0x2
+    fAddSeals       = 1033
+    fSealSeal       = 0x1
+    fSealShrink     = 0x2
+    fSealGrow       = 0x4
+    fSealWrite      = 0x8
+)
+
+// memfd_create(2) syscall numbers, as the syscall package only defines them
+// for some architectures.
+var memfdTrap = map[string]uintptr{
+    "386":      356,
+    "amd64":    319,
+    "arm":      385,
+    "arm64":    279,
+    "loong64":  279,
+    "mips":     4354,
+    "mipsle":   4354,
+    "mips64":   5314,
+    "mips64le": 5314,
+    "ppc64":    360,
+    "ppc64le":  360,
+    "riscv64":  279,
+    "s390x":    350,
+}
+
+// Total size of the memfds OpenFd() keeps cached for later opens. The least
+// recently opened ones are closed to make room for new ones.
+const MEMFD_CACHE_SIZE = 64 * 1024 * 1024
+
+// Sealed memfds holding bundle objects, most recently opened first, kept open
+// until evicted or a patch is applied (see dropMemfds()).
+var memfds = struct {
+    sync.Mutex
+    files   map[*Object]*list.Element
+    lru     *list.List
+    size    int64
+    max     int64
+}{ files: make(map[*Object]*list.Element), lru: list.New(), max: MEMFD_CACHE_SIZE }
+
+// A cached memfd and the object it holds.
+type memfdEntry struct {
+    obj     *Object
+    file    *os.File
+}
+
+// OpenFd opens the named file for reading and returns it as a real *os.File,
+// backed by a kernel file descriptor that can be handed to cgo libraries,
+// exec.Cmd.ExtraFiles, syscall.Sendfile and the like. Bundle files are
+// materialized in a sealed, read-only memfd the first time they're opened;
+// later opens reuse it, as long as it's among the most recently opened ones
+// (see MEMFD_CACHE_SIZE). Files not held in RAM (see
+// BundleOptions.ExternalThreshold) are copied to a new memfd every time, which
+// lives as long as the returned file. Each call returns a new file description
+// (with its own offset), which the caller must close. Files outside the bundle
+// are opened through the os package.
+func OpenFd(name string) (*os.File, error) {
+    // Files modified through the overlay can change, so they're never cached
+    if data, ok, err := readUpper(name); ok {
+        if err != nil { return nil, err }
+        mfd, err := newMemfd(name, bytes.NewReader(data), int64(len(data)))
+        if err != nil { return nil, pathError("open", name, err) }
+        return mfd, nil
+    }
+
+    obj, err := findObject(name)
+    if err != nil { return os.Open(nativePath(name)) }
+    if obj.ModeBits.IsDir() { return nil, pathError("open", name, syscall.EISDIR) }
+
+    // Empty files have no payload to read
+    var r io.ReaderAt = bytes.NewReader(nil)
+    if obj.Size != 0 {
+        r, err = getPayloadReader(obj)
+        if err != nil { return nil, pathError("open", name, err) }
+    }
+
+    // External files would be brought into RAM for good if cached
+    if obj.External || obj.Size > memfds.max {
+        mfd, err := newMemfd(name, r, obj.Size)
+        if err != nil { return nil, pathError("open", name, err) }
+        return mfd, nil
+    }
+
+    memfds.Lock()
+    defer memfds.Unlock()
+
+    e, ok := memfds.files[obj]
+    if ok {
+        memfds.lru.MoveToFront(e)
+    } else {
+        mfd, err := newMemfd(name, r, obj.Size)
+        if err != nil { return nil, pathError("open", name, err) }
+        e = memfds.lru.PushFront(&memfdEntry{ obj, mfd })
+        memfds.files[obj] = e
+        memfds.size += obj.Size
+        evictMemfds()
+    }
+
+    // Reopen for a private offset
+    file, err := reopenFile(e.Value.(*memfdEntry).file, name)
+    if err != nil { return nil, pathError("open", name, err) }
+
+    return file, nil
+}
+
+// Close the least recently opened memfds until the cache fits its maximum
+// size. Files returned by OpenFd() stay valid.
+func evictMemfds() {
+    for memfds.size > memfds.max {
+        entry := memfds.lru.Remove(memfds.lru.Back()).(*memfdEntry)
+        delete(memfds.files, entry.obj)
+        memfds.size -= entry.obj.Size
+        entry.file.Close()
+    }
+}
+
+// Drop cached memfds. Patches shuffle objects around in the tree, so cached
+// memfds may no longer match the objects they're keyed by. Files returned by
+// OpenFd() have file descriptions of their own and stay valid.
+func dropMemfds() {
+    memfds.Lock()
+    defer memfds.Unlock()
+
+    for e := memfds.lru.Front(); e != nil; e = e.Next() {
+        e.Value.(*memfdEntry).file.Close()
+    }
+    memfds.files = make(map[*Object]*list.Element)
+    memfds.lru.Init()
+    memfds.size = 0
+}
+
+// Open a new read-only file description for an open file, which may have been
+// unlinked or replaced on disk since. The new file is called name.
+func reopenFile(f *os.File, name string) (*os.File, error) {
+    fd, err := syscall.Open("/proc/self/fd/" + strconv.Itoa(int(f.Fd())),
+        syscall.O_RDONLY | syscall.O_CLOEXEC, 0)
+    if err != nil { return nil, err }
+    return os.NewFile(uintptr(fd), name), nil
+}
+
+// Create a sealed memfd holding size bytes read from r.
+func newMemfd(name string, r io.ReaderAt, size int64) (*os.File, error) {
+    trap, ok := memfdTrap[runtime.GOARCH]
+    if !ok { return nil, syscall.ENOSYS }
+
+    label, err := syscall.BytePtrFromString("caviar")
+    if err != nil { return nil, debug(err) }
+    fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(label)),
+        mfdCloexec | mfdAllowSealing, 0)
+    if errno != 0 { return nil, debug(errno) }
+
+    f := os.NewFile(fd, name)
+    _, err = io.Copy(f, io.NewSectionReader(r, 0, size))
+    if err != nil {
+        f.Close()
+        return nil, debug(err)
+    }
+
+    _, _, errno = syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), fAddSeals,
+        fSealSeal | fSealShrink | fSealGrow | fSealWrite)
+    if errno != 0 {
+        f.Close()
+        return nil, debug(errno)
+    }
+
+    _, err = f.Seek(0, io.SeekStart)
+    if err != nil {
+        f.Close()
+        return nil, debug(err)
+    }
+
+    return f, nil
+}
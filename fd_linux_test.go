@@ -0,0 +1,73 @@
+// +build linux
+
+package caviar
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+)
+
+func TestOpenFd(t *testing.T) {
+    for name, want := range testFiles {
+        if filepath.Ext(name) == "" { continue }
+
+        f, err := OpenFd(filepath.Join(testPrefix, name))
+        if err != nil { t.Fatal(err) }
+        data, err := ioutil.ReadAll(f)
+        f.Close()
+        if err != nil { t.Fatal(err) }
+
+        if string(data) != want { t.Errorf("%v: read %q, want %q.", name, data, want) }
+    }
+}
+
+// Return the inode number of an open file.
+func testInode(t *testing.T, f *os.File) uint64 {
+    fi, err := f.Stat()
+    if err != nil { t.Fatal(err) }
+    return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+// Open a bundle file twice with OpenFd() and report whether both share the
+// same memfd.
+func testSameMemfd(t *testing.T, name string) bool {
+    a, err := OpenFd(filepath.Join(testPrefix, name))
+    if err != nil { t.Fatal(err) }
+    defer a.Close()
+    b, err := OpenFd(filepath.Join(testPrefix, name))
+    if err != nil { t.Fatal(err) }
+    defer b.Close()
+    return testInode(t, a) == testInode(t, b)
+}
+
+func TestOpenFdCache(t *testing.T) {
+    dropMemfds()
+    defer func() {
+        memfds.max = MEMFD_CACHE_SIZE
+        dropMemfds()
+    }()
+
+    if !testSameMemfd(t, "index.html") { t.Fatal("Second OpenFd() didn't reuse the memfd.") }
+    if testSameMemfd(t, "ext/big.bin") { t.Fatal("External file was cached.") }
+
+    // Room for big.bin and b.txt, but not index.html on top
+    memfds.max = int64(len(testFiles["big.bin"]) + len(testFiles["sub/deeper/b.txt"]))
+    dropMemfds()
+    for _, name := range []string{ "big.bin", "sub/deeper/b.txt", "big.bin", "index.html" } {
+        f, err := OpenFd(filepath.Join(testPrefix, name))
+        if err != nil { t.Fatal(err) }
+        f.Close()
+    }
+
+    if memfds.size > memfds.max { t.Fatalf("Cache holds %v bytes, more than %v.", memfds.size, memfds.max) }
+    for name, want := range map[string]bool{ "big.bin": true, "sub/deeper/b.txt": false, "index.html": true } {
+        obj, err := lookupObject(name)
+        if err != nil { t.Fatal(err) }
+        if _, cached := memfds.files[obj]; cached != want {
+            t.Errorf("%v: cached %v, want %v.", name, cached, want)
+        }
+    }
+}
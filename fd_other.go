@@ -0,0 +1,34 @@
+// +build !linux
+
+// fd_other.go stubs out OpenFd on platforms without memfd_create(2).
+
+package caviar
+
+import (
+    "errors"
+    "os"
+)
+
+// OpenFd is only supported on Linux. Elsewhere it fails for files in the
+// bundle (or the writable overlay) and opens other files through the os
+// package.
+func OpenFd(name string) (*os.File, error) {
+    _, err := statOverlay(name)
+    if err != nil { _, err = findObject(name) }
+    if err != nil { return os.Open(nativePath(name)) }
+    return nil, pathError("open", name, errors.New("OpenFd is only supported on Linux."))
+}
+
+// Total size of the memfds OpenFd() keeps cached on Linux. Unused elsewhere.
+const MEMFD_CACHE_SIZE = 64 * 1024 * 1024
+
+// There are no cached memfds to drop.
+func dropMemfds() {}
+
+// Open a new read-only file description for an open file. Without /proc, this
+// means opening it again by its original name, which the new file keeps.
+func reopenFile(f *os.File, name string) (*os.File, error) {
+    file, err := os.Open(f.Name())
+    if err != nil { return nil, err }
+    return file, nil
+}
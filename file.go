@@ -4,11 +4,15 @@ package caviar
 
 import (
     "io"
+    "io/fs"
     "os"
     "errors"
+    "syscall"
 )
 
 // Maximum number of bytes to read when calling Read().
+//
+// Deprecated: Read() no longer caps reads, so this is unused.
 const READ_MAX = 1024 * 32
 
 // File mimicks the os.File type's entire public API so Caviar can serve as a
@@ -31,81 +35,174 @@ type File interface {
     Chown(int, int) error
     Readdir(n int) (fi []os.FileInfo, err error)
     Readdirnames(n int) (names []string, err error)
+    ReadDir(n int) ([]fs.DirEntry, error)
 }
 
 // CaviarFile implements caviar.File and serves as a replacement for os.File.
+// As with os.File, errors returned by its methods are of type *os.PathError.
 type CaviarFile struct {
-    obj *Object
-    fd  int64
-    pos int64
+    obj     *Object
+    name    string
+    fd      int64
+    pos     int64
+    // Native directory whose entries are merged into directory listings.
+    // Empty if there's none (i.e. for files opened through FS()).
+    native  string
+    // Path relative to the object root, used to merge in overlay entries.
+    // Empty if the overlay is to be ignored (i.e. for files opened through
+    // FS()).
+    rel     string
+    // Directory listing, built on the first call to Readdir.
+    dirents []os.FileInfo
+}
+
+// Make sure the file hasn't been closed.
+func (f *CaviarFile) checkValid(op string) error {
+    if f == nil { return os.ErrInvalid }
+    if f.obj == nil { return pathError(op, f.name, os.ErrClosed) }
+    return nil
 }
 
 // Read mimicks os.File.Read().
 func (f *CaviarFile) Read(b []byte) (int, error) {
+    if err := f.checkValid("read"); err != nil { return 0, err }
+
     // Directory? No can do!
     if f.obj.ModeBits.IsDir() {
-        return 0, debug(errors.New("Can't read data from a directory."))
+        return 0, pathError("read", f.name, syscall.EISDIR)
     }
 
     // How much are we going to read?
     n := int64(len(b))
     l := f.obj.Size - f.pos
-    if n > READ_MAX { n = READ_MAX }
     if n > l { n = l }
-    if n == 0 { return 0, io.EOF }
+    if n == 0 && len(b) == 0 { return 0, nil }
+    if n <= 0 { return 0, io.EOF }
 
     // Make the copy
-    data, err := getPayload(f.obj)
-    if err != nil { return 0, debug(err) }
+    r, err := getPayloadReader(f.obj)
+    if err != nil { return 0, pathError("read", f.name, err) }
 
-    copy(b, data[f.pos:f.pos+n])
+    m, err := r.ReadAt(b[:n], f.pos)
+    if err != nil && err != io.EOF { return m, pathError("read", f.name, err) }
 
     // Update read position
+    f.pos += int64(m)
+
+    return m, nil
+}
+
+// WriteTo implements io.WriterTo, so io.Copy() hands the rest of the file to
+// w in one go instead of copying it through a buffer. Payloads held in RAM are
+// written with a single call to w.Write(). Payloads read from the container
+// file are handed to w's ReadFrom() as an *os.File, which lets *net.TCPConn
+// use sendfile(2) or splice(2). Note http.ServeContent (and so http.FileServer)
+// copies through an io.LimitedReader, which hides WriteTo; FileServer() has a
+// fast path of its own.
+func (f *CaviarFile) WriteTo(w io.Writer) (int64, error) {
+    if err := f.checkValid("read"); err != nil { return 0, err }
+
+    if f.obj.ModeBits.IsDir() {
+        return 0, pathError("read", f.name, syscall.EISDIR)
+    }
+
+    l := f.obj.Size - f.pos
+    if l <= 0 { return 0, nil }
+
+    // In RAM
+    if !f.obj.External {
+        data, err := getPayload(f.obj)
+        if err != nil { return 0, pathError("read", f.name, err) }
+        n, err := w.Write(data[f.pos:])
+        f.pos += int64(n)
+        return int64(n), err
+    }
+
+    // In the container file
+    if rf, ok := w.(io.ReaderFrom); ok {
+        if p, ok := f.obj.ext.(*filePayload); ok {
+            n, err := sendPayload(rf, p, f.obj.Offset + f.pos, l)
+            f.pos += n
+            if err != nil { return n, pathError("read", f.name, err) }
+            return n, nil
+        }
+    }
+
+    r, err := getPayloadReader(f.obj)
+    if err != nil { return 0, pathError("read", f.name, err) }
+    n, err := io.Copy(w, io.NewSectionReader(r, f.pos, l))
     f.pos += n
+    return n, err
+}
+
+// Hand size bytes of an external payload, starting at offset, to rf. The
+// container file is reopened so the transfer gets a file offset of its own.
+func sendPayload(rf io.ReaderFrom, p *filePayload, offset, size int64) (int64, error) {
+    file, err := reopenFile(p.file, p.file.Name())
+    if err != nil { return 0, debug(err) }
+    defer file.Close()
+
+    _, err = file.Seek(p.base + offset, io.SeekStart)
+    if err != nil { return 0, debug(err) }
 
-    return int(n), nil
+    return rf.ReadFrom(&io.LimitedReader{ R: file, N: size })
 }
 
 // ReadAt mimicks os.File.ReadAt().
 func (f *CaviarFile) ReadAt(b []byte, off int64) (int, error) {
+    if err := f.checkValid("read"); err != nil { return 0, err }
+
     // Directory? No can do!
     if f.obj.ModeBits.IsDir() {
-        return 0, debug(errors.New("Can't read data from a directory."))
+        return 0, pathError("read", f.name, syscall.EISDIR)
+    }
+
+    if off < 0 {
+        return 0, pathError("readat", f.name, errors.New("negative offset"))
     }
 
     // How much are we going to read?
     n := int64(len(b))
     l := f.obj.Size - off
     if n > l { n = l }
-    if n == 0 { return 0, io.EOF }
-    if n < 0 { return 0, errors.New("Can't read before the beginning of the file!") }
+    if n <= 0 {
+        if len(b) == 0 { return 0, nil }
+        return 0, io.EOF
+    }
 
     // Make the copy
-    data, err := getPayload(f.obj)
-    if err != nil { return 0, debug(err) }
+    r, err := getPayloadReader(f.obj)
+    if err != nil { return 0, pathError("read", f.name, err) }
 
-    copy(b, data[off:off+n])
+    m, err := r.ReadAt(b[:n], off)
+    if err != nil && err != io.EOF { return m, pathError("read", f.name, err) }
 
-    return int(n), nil
+    // Short reads must come with an error, as per io.ReaderAt.
+    if m < len(b) { return m, io.EOF }
+    return m, nil
 }
 
 // Write mimicks os.File.Write(). It always returns an error as Caviar files
 // are read-only.
 func (f *CaviarFile) Write(b []byte) (n int, err error) {
-    return 0, debug(errors.New("Can't write file: caviar files are read-only."))
+    if err := f.checkValid("write"); err != nil { return 0, err }
+    return 0, pathError("write", f.name, os.ErrPermission)
 }
 
 // WriteAt mimicks os.File.WriteAt(). It always returns an error as Caviar
 // files are read-only.
 func (f *CaviarFile) WriteAt(b []byte, off int64) (int, error) {
-    return 0, debug(errors.New("Can't write file: caviar files are read-only."))
+    if err := f.checkValid("write"); err != nil { return 0, err }
+    return 0, pathError("write", f.name, os.ErrPermission)
 }
 
 // Seek mimicks os.File.Seek().
 func (f *CaviarFile) Seek(offset int64, whence int) (pos int64, err error) {
+    if err := f.checkValid("seek"); err != nil { return 0, err }
+
     // Directory? No can do!
     if f.obj.ModeBits.IsDir() {
-        return 0, debug(errors.New("Can't seek through a directory."))
+        return 0, pathError("seek", f.name, syscall.EISDIR)
     }
 
     // Seek, seek, seek!
@@ -115,13 +212,13 @@ func (f *CaviarFile) Seek(offset int64, whence int) (pos int64, err error) {
         pos = f.pos + offset        // From current position
     } else if whence == os.SEEK_END {
         pos = f.obj.Size + offset   // From end of file
+    } else {
+        return f.pos, pathError("seek", f.name, os.ErrInvalid)
     }
 
     // Did we go over or under?
-    if f.obj.Size < pos {
-        return f.pos, debug(errors.New("Attempted to Seek() beyond end of file."))
-    } else if pos < 0 {
-        return f.pos, debug(errors.New("Attempted to Seek() before start of file."))
+    if f.obj.Size < pos || pos < 0 {
+        return f.pos, pathError("seek", f.name, os.ErrInvalid)
     }
 
     f.pos = pos
@@ -130,101 +227,123 @@ func (f *CaviarFile) Seek(offset int64, whence int) (pos int64, err error) {
 
 // Close mimicks os.File.Close()
 func (f *CaviarFile) Close() error {
-    if f.obj == nil {
-        return debug(errors.New("File already closed."))
-    }
+    if err := f.checkValid("close"); err != nil { return err }
     f.obj = nil
     return nil
 }
 
 // Stat mimicks os.File.Stat().
 func (f *CaviarFile) Stat() (os.FileInfo, error) {
+    if err := f.checkValid("stat"); err != nil { return nil, err }
     return &CaviarFileInfo{ f.obj }, nil
 }
 
-// Name mimicks os.File.Name().
+// Name mimicks os.File.Name(). It returns the name of the file as presented
+// to Open.
 func (f *CaviarFile) Name() string {
-    return f.obj.Name
+    return f.name
 }
 
-// Chdir mimicks os.File.Chdir(). It will return with an error unless
-// EXTRACT_EXECUTABLE is used as the extraction mode for the bundle as it's not
-// possible to chdir to a virtual, in-memory directory (EXTRACT_MEMORY) and
-// doing so for EXTRACT_TEMP would screw up relative paths causing subtle bugs.
+// Chdir mimicks os.File.Chdir(). Directories inside the bundle become the
+// virtual working directory (see caviar.Chdir()). Files opened through FS()
+// can't be chdir'ed to.
 func (f *CaviarFile) Chdir() error {
-    // TODO: account for extraction mode as the docstring explains.
-    return debug(errors.New("Can't chdir to file's directory: caviar files exist only in memory."))
+    if err := f.checkValid("chdir"); err != nil { return err }
+    if f.rel == "" { return pathError("chdir", f.name, os.ErrInvalid) }
+    if !f.obj.ModeBits.IsDir() { return pathError("chdir", f.name, syscall.ENOTDIR) }
+    return Chdir(f.native)
 }
 
 // Sync mimicks os.File.Sync(). It always returns an error as Caviar files are
 // read-only.
 func (f *CaviarFile) Sync() (err error) {
-    return debug(errors.New("Can't sync file: caviar files are read-only."))
+    if err := f.checkValid("sync"); err != nil { return err }
+    return pathError("sync", f.name, os.ErrPermission)
 }
 
 // Fd mimicks os.File.Fd(). The returned file descriptor is a dummy value that
-// is unlikely to repeat across Open files (but no guarantees).
+// is unlikely to repeat across Open files (but no guarantees). As with os.File,
+// ^uintptr(0) is returned for closed files. Use OpenFd() to get a real one.
 func (f *CaviarFile) Fd() uintptr {
+    if f == nil || f.obj == nil { return ^uintptr(0) }
     return uintptr(f.fd)
 }
 
 // Truncate mimicks os.File.Truncate(). It always returns an error as Caviar
 // files are read-only.
 func (f *CaviarFile) Truncate(size int64) error {
-    return debug(errors.New("Can't truncate file: caviar files are read-only."))
+    if err := f.checkValid("truncate"); err != nil { return err }
+    return pathError("truncate", f.name, os.ErrPermission)
 }
 
 // WriteString mimicks os.File.WriteString(). It always returns an error as
 // Caviar files are read-only.
 func (f *CaviarFile) WriteString(s string) (int, error) {
-    if len(s) == 0 { return 0, nil }
-    return 0, debug(errors.New("Can't write file: caviar files are read-only."))
+    return f.Write([]byte(s))
 }
 
-// Chmod mimicks os.File.Chmod(). It always returns an error as Caviar files
-// are read-only.
+// Chmod mimicks os.File.Chmod(). Caviar files are read-only, so it returns an
+// error unless the writable overlay is enabled, in which case the file is
+// copied up first.
 func (f *CaviarFile) Chmod(mode os.FileMode) error {
-    return debug(errors.New("Can't chmod file: caviar files are read-only."))
+    if err := f.checkValid("chmod"); err != nil { return err }
+    if state.overlay != nil && f.rel != "" { return overlayChmod(f.name, f.rel, mode) }
+    return pathError("chmod", f.name, os.ErrPermission)
 }
 
 // Chown mimicks os.File.Chown(). It always returns an error as Caviar files
 // are read-only.
 func (f *CaviarFile) Chown(uid, gid int) error {
-    return debug(errors.New("Can't chown file: caviar files are read-only."))
+    if err := f.checkValid("chown"); err != nil { return err }
+    return pathError("chown", f.name, os.ErrPermission)
 }
 
-// Readdir mimicks os.File.Readdir().
+// Readdir mimicks os.File.Readdir(). For directories that exist both in the
+// bundle and on disk, the listing merges both (see SetPrecedence()). The
+// listing is sorted by name and built on the first call, so later changes to
+// the native directory won't be reflected until the file is opened again.
 func (f *CaviarFile) Readdir(n int) (fi []os.FileInfo, err error) {
+    if err := f.checkValid("readdir"); err != nil { return nil, err }
+
     // File? No can do!
     if !f.obj.ModeBits.IsDir() {
-        return fi, debug(errors.New("Files can't contain other files and directories!."))
+        return fi, pathError("readdirent", f.name, syscall.ENOTDIR)
     }
 
     // Build dir list
-    for i := f.pos; i < int64(len(f.obj.Objects)); i++ {
-        if n > 0 && i == int64(n) { break }
-        fi = append(fi, &CaviarFileInfo{ &f.obj.Objects[i] })
+    if f.dirents == nil {
+        f.dirents, err = mergeDir(f.obj, f.rel, f.native)
+        if err != nil { return nil, err }
+        if f.dirents == nil { f.dirents = []os.FileInfo{} }
     }
-    if n > 0 && len(fi) == 0 { return fi, io.EOF }
+
+    // Return the next batch
+    rest := f.dirents[f.pos:]
+    if n > 0 && len(rest) == 0 { return nil, io.EOF }
+    if n > 0 && n < len(rest) { rest = rest[:n] }
+
+    fi = make([]os.FileInfo, len(rest))
+    copy(fi, rest)
 
     f.pos += int64(len(fi))
     return fi, nil
 }
 
-// Readdirnames mimicks os.File.Readdirnames().
+// Readdirnames mimicks os.File.Readdirnames(). See Readdir().
 func (f *CaviarFile) Readdirnames(n int) (names []string, err error) {
-    // File? No can do!
-    if !f.obj.ModeBits.IsDir() {
-        return names, debug(errors.New("Files can't contain other files and directories!."))
+    fi, err := f.Readdir(n)
+    for _, entry := range fi {
+        names = append(names, entry.Name())
     }
+    return names, err
+}
 
-    // Build dir list
-    for i := f.pos; i < int64(len(f.obj.Objects)); i++ {
-        if n > 0 && i == int64(n) { break }
-        names = append(names, f.obj.Objects[i].Name)
+// ReadDir mimicks os.File.ReadDir() and implements fs.ReadDirFile.
+func (f *CaviarFile) ReadDir(n int) ([]fs.DirEntry, error) {
+    fi, err := f.Readdir(n)
+    entries := make([]fs.DirEntry, len(fi))
+    for i := 0; i < len(fi); i++ {
+        entries[i] = fs.FileInfoToDirEntry(fi[i])
     }
-    if n > 0 && len(names) == 0 { return names, io.EOF }
-
-    f.pos += int64(len(names))
-    return names, nil
+    return entries, err
 }
@@ -0,0 +1,122 @@
+package caviar
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// Lay out a native directory at the same path as the bundle's "sub", sharing
+// an entry with it, and return its path.
+func testNativeSub(t *testing.T) string {
+    dir := filepath.Join(testPrefix, "sub")
+    t.Cleanup(func() { os.RemoveAll(testPrefix) })
+
+    err := os.MkdirAll(filepath.Join(dir, "ndir"), 0755)
+    if err != nil { t.Fatal(err) }
+    for _, name := range []string{ "a.txt", "native.txt", "x.txt" } {
+        err = ioutil.WriteFile(filepath.Join(dir, name), []byte("native " + name), 0644)
+        if err != nil { t.Fatal(err) }
+    }
+    return dir
+}
+
+// Describe a listing: names, plus sizes for files and a slash for
+// directories.
+func testListing(list []os.FileInfo) []string {
+    var names []string
+    for _, fi := range list {
+        if fi.IsDir() {
+            names = append(names, fi.Name() + "/")
+        } else {
+            names = append(names, fmt.Sprintf("%v:%v", fi.Name(), fi.Size()))
+        }
+    }
+    return names
+}
+
+// List a directory with Readdir(-1).
+func testReaddir(t *testing.T, dir string) []os.FileInfo {
+    f, err := Open(dir)
+    if err != nil { t.Fatal(err) }
+    defer f.Close()
+    list, err := f.Readdir(-1)
+    if err != nil { t.Fatal(err) }
+    return list
+}
+
+func TestReadDirMerged(t *testing.T) {
+    dir := testNativeSub(t)
+    // The bundle's a.txt shadows the native one.
+    want := []string{ "a.txt:1", "deeper/", "native.txt:17", "ndir/", "x.txt:12" }
+
+    check := func(what string) {
+        list := testListing(testReaddir(t, dir))
+        if !reflect.DeepEqual(list, want) { t.Fatalf("%v: Readdir(-1) returned %v, want %v.", what, list, want) }
+
+        fis, err := ReadDir(dir)
+        if err != nil { t.Fatal(err) }
+        if got := testListing(fis); !reflect.DeepEqual(got, list) {
+            t.Fatalf("%v: ReadDir() returned %v, Readdir(-1) %v.", what, got, list)
+        }
+
+        entries, err := ReadDirEntries(dir)
+        if err != nil { t.Fatal(err) }
+        fis = nil
+        for _, e := range entries {
+            fi, err := e.Info()
+            if err != nil { t.Fatal(err) }
+            fis = append(fis, fi)
+        }
+        if got := testListing(fis); !reflect.DeepEqual(got, list) {
+            t.Fatalf("%v: ReadDirEntries() returned %v, Readdir(-1) %v.", what, got, list)
+        }
+    }
+
+    check("Bundle only")
+
+    err := EnableOverlay("")
+    if err != nil { t.Fatal(err) }
+    defer func() { state.overlay = nil }()
+
+    f, err := OpenFile(filepath.Join(dir, "upper.txt"), os.O_WRONLY | os.O_CREATE, 0644)
+    if err != nil { t.Fatal(err) }
+    _, err = f.Write([]byte("up"))
+    f.Close()
+    if err != nil { t.Fatal(err) }
+    want = []string{ "a.txt:1", "deeper/", "native.txt:17", "ndir/", "upper.txt:2", "x.txt:12" }
+
+    check("Overlay")
+}
+
+func TestReaddirPaged(t *testing.T) {
+    dir := testNativeSub(t)
+    all := testListing(testReaddir(t, dir))
+
+    f, err := Open(dir)
+    if err != nil { t.Fatal(err) }
+    defer f.Close()
+
+    var paged []string
+    seen := make(map[string]bool)
+    for {
+        list, err := f.Readdir(2)
+        if err == io.EOF { break }
+        if err != nil { t.Fatal(err) }
+        if len(list) == 0 || len(list) > 2 { t.Fatalf("Readdir(2) returned %v entries.", len(list)) }
+
+        for _, fi := range list {
+            if seen[fi.Name()] { t.Fatalf("Readdir(2) returned %v twice.", fi.Name()) }
+            seen[fi.Name()] = true
+        }
+        paged = append(paged, testListing(list)...)
+    }
+
+    if !reflect.DeepEqual(paged, all) {
+        t.Fatalf("Readdir(2) returned %v, Readdir(-1) %v.", paged, all)
+    }
+}
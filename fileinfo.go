@@ -26,13 +26,62 @@ func (fi *CaviarFileInfo) Mode() os.FileMode {
 }
 
 func (fi *CaviarFileInfo) ModTime() time.Time {
-    return time.Unix(fi.obj.ModTime, 0)
+    return time.Unix(fi.obj.ModTime, fi.obj.ModTimeNsec)
 }
 
 func (fi *CaviarFileInfo) IsDir() bool {
     return fi.Mode().IsDir()
 }
 
+// Sys returns the object's extended metadata as an *ObjectMeta.
 func (fi *CaviarFileInfo) Sys() interface{} {
-    return nil
+    return newObjectMeta(fi.obj)
+}
+
+// ObjectMeta holds the extended metadata recorded for a bundled file or
+// directory. It's what CaviarFileInfo.Sys() returns, much like os.FileInfo
+// returns a *syscall.Stat_t for native files. Apart from the modification time,
+// MIME type and user tags, fields are only populated if the bundle was created
+// with extended metadata enabled (see BundleOptions.ExtendedMeta).
+type ObjectMeta struct {
+    // Modification time with nanosecond resolution (if recorded).
+    ModTime     time.Time
+    // Numeric owner and group IDs.
+    Uid         int
+    Gid         int
+    // MIME type determined when the bundle was created.
+    MimeType    string
+    // Extended attributes, indexed by name.
+    Xattrs      map[string][]byte
+    // User-supplied tags.
+    Tags        map[string]string
+}
+
+// Meta returns the extended metadata for the bundled file or directory named
+// by path. It does not fall back to the native OS.
+func Meta(path string) (*ObjectMeta, error) {
+    obj, err := findObject(path)
+    if err != nil { return nil, pathError("meta", path, err) }
+
+    return newObjectMeta(obj), nil
+}
+
+// Build an ObjectMeta out of an Object. The returned maps are copies, so
+// callers are free to modify them.
+func newObjectMeta(obj *Object) *ObjectMeta {
+    meta := &ObjectMeta{
+        ModTime:    time.Unix(obj.ModTime, obj.ModTimeNsec),
+        Uid:        obj.Uid,
+        Gid:        obj.Gid,
+        MimeType:   obj.MimeType,
+        Xattrs:     make(map[string][]byte, len(obj.Xattrs)),
+        Tags:       make(map[string]string, len(obj.Tags)),
+    }
+    for _, x := range obj.Xattrs {
+        meta.Xattrs[x.Name] = append([]byte(nil), x.Value...)
+    }
+    for _, t := range obj.Tags {
+        meta.Tags[t.Key] = t.Value
+    }
+    return meta
 }
@@ -1,17 +1,151 @@
 // filepath.go implements drop-in replacement functions for the path/filepath
-// package.
+// package. They operate on the merged view of the bundle and the native OS
+// file system, with bundle entries shadowing native ones.
 
 package caviar
 
 import (
-    "errors"
+    "io/fs"
+    "os"
     "path/filepath"
+    "runtime"
+    "strings"
 )
 
+// Walk mimicks filepath.Walk(). Files and directories are walked in lexical
+// order, and directories present both in the bundle and on disk are walked
+// through their merged contents.
 func Walk(root string, walkFn filepath.WalkFunc) error {
-    return debug(errors.New("Walk(): Not Implemented.")) // TODO
+    info, err := Lstat(root)
+    if err != nil {
+        err = walkFn(root, nil, err)
+    } else {
+        err = walk(root, info, walkFn)
+    }
+    if err == filepath.SkipDir || err == filepath.SkipAll { return nil }
+    return err
 }
 
+// Recursively walk path, calling walkFn.
+func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+    if !info.IsDir() { return walkFn(path, info, nil) }
+
+    list, err := readDirMerged(path)
+    err1 := walkFn(path, info, err)
+    // If err != nil, walk can't walk into this directory. err1 != nil means
+    // walkFn wants walk to skip this directory or stop walking. Either way,
+    // we're done here.
+    if err != nil || err1 != nil { return err1 }
+
+    for _, fi := range list {
+        err = walk(filepath.Join(path, fi.Name()), fi, walkFn)
+        if err != nil {
+            if !fi.IsDir() || err != filepath.SkipDir { return err }
+        }
+    }
+    return nil
+}
+
+// WalkDir mimicks filepath.WalkDir(). See Walk().
+func WalkDir(root string, fn fs.WalkDirFunc) error {
+    info, err := Lstat(root)
+    if err != nil {
+        err = fn(root, nil, err)
+    } else {
+        err = walkDir(root, fs.FileInfoToDirEntry(info), fn)
+    }
+    if err == filepath.SkipDir || err == filepath.SkipAll { return nil }
+    return err
+}
+
+// Recursively walk path, calling fn.
+func walkDir(path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+    if err := fn(path, d, nil); err != nil || !d.IsDir() {
+        if err == filepath.SkipDir && d.IsDir() { err = nil }
+        return err
+    }
+
+    list, err := readDirMerged(path)
+    if err != nil {
+        // Second call, to report the ReadDir error.
+        err = fn(path, d, err)
+        if err != nil {
+            if err == filepath.SkipDir && d.IsDir() { err = nil }
+            return err
+        }
+    }
+
+    for _, fi := range list {
+        err := walkDir(filepath.Join(path, fi.Name()), fs.FileInfoToDirEntry(fi), fn)
+        if err != nil {
+            if err == filepath.SkipDir { break }
+            return err
+        }
+    }
+    return nil
+}
+
+// Glob mimicks filepath.Glob(), matching against the union of bundle and
+// native files.
 func Glob(pattern string) (matches []string, err error) {
-    return nil, debug(errors.New("Glob(): Not Implemented.")) // TODO
+    // Check pattern is well-formed.
+    if _, err := filepath.Match(pattern, ""); err != nil { return nil, err }
+
+    if !hasMeta(pattern) {
+        if _, err = Lstat(pattern); err != nil { return nil, nil }
+        return []string{ pattern }, nil
+    }
+
+    dir, file := filepath.Split(pattern)
+    dir = cleanGlobPath(dir)
+
+    if !hasMeta(dir) { return glob(dir, file, nil) }
+
+    // Prevent infinite recursion.
+    if dir == pattern { return nil, filepath.ErrBadPattern }
+
+    m, err := Glob(dir)
+    if err != nil { return nil, err }
+    for _, d := range m {
+        matches, err = glob(d, file, matches)
+        if err != nil { return nil, err }
+    }
+    return matches, nil
+}
+
+// Search dir for files matching pattern and append them to matches. I/O
+// errors are ignored, as with filepath.Glob().
+func glob(dir, pattern string, matches []string) ([]string, error) {
+    fi, err := Stat(dir)
+    if err != nil || !fi.IsDir() { return matches, nil }
+
+    list, err := readDirMerged(dir)
+    if err != nil { return matches, nil }
+
+    for _, fi := range list {
+        matched, err := filepath.Match(pattern, fi.Name())
+        if err != nil { return matches, err }
+        if matched { matches = append(matches, filepath.Join(dir, fi.Name())) }
+    }
+    return matches, nil
+}
+
+// Prepare a directory path for globbing.
+func cleanGlobPath(path string) string {
+    switch path {
+    case "":
+        return "."
+    case string(filepath.Separator):
+        return path
+    default:
+        return path[0:len(path)-1] // chop off trailing separator
+    }
+}
+
+// Report whether path contains any of the magic characters recognized by
+// filepath.Match().
+func hasMeta(path string) bool {
+    magic := `*?[\`
+    if runtime.GOOS == "windows" { magic = `*?[` }
+    return strings.ContainsAny(path, magic)
 }
@@ -0,0 +1,370 @@
+// fileserver.go implements an http.FileServer replacement that takes
+// advantage of what the bundle knows about its files.
+
+package caviar
+
+import (
+    "bytes"
+    "io"
+    "io/ioutil"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "html/template"
+)
+
+// FileServerHandler serves files like http.FileServer does, except that bundle
+// files with a precompressed gzip variant (see cavundle's -gzip option) are
+// served compressed to clients that accept it, and bundle files carry a strong
+// ETag (their SHA-256 hash) so If-None-Match (as well as If-Modified-Since)
+// revalidation is answered with 304 Not Modified. Range requests apply to the
+// representation being served. Fingerprinted names (see AssetURL()) are mapped
+// back to the files they came from and marked immutable. Index documents and
+// directory listings can be configured per handler (that is, per URL mount).
+// Bundle files are written straight from RAM, or sent from the container file
+// with sendfile(2). Redirects and files outside the bundle are handled as by
+// http.FileServer.
+type FileServerHandler struct {
+    Root        Dir
+    // Single-page app fallbacks: GET and HEAD requests for paths starting
+    // with a given prefix (i.e. “/app/”) that don't exist are answered with
+    // the corresponding document (a path under Root, i.e. “/app/index.html”)
+    // rather than a 404. Requests whose last path segment has an extension
+    // are left alone, so missing assets still 404. The longest prefix wins.
+    Fallbacks   map[string]string
+    // Custom error pages (paths under Root), by status code (i.e. 404 or
+    // 500). They're served with the original status code in place of the
+    // plain text error responses.
+    ErrorPages  map[int]string
+    // Documents served for directory requests, tried in order. Defaults to
+    // DEFAULT_INDEX_FILES. Set to an empty, non-nil slice to disable them.
+    IndexFiles  []string
+    // Directories without an index document 404 rather than being listed.
+    DisableListing  bool
+    // html/template used to render directory listings (a path under Root),
+    // instead of http.FileServer's plain one. It's executed with a *Listing
+    // and can call the functions in FuncMap(). It's loaded on first use.
+    ListingTemplate string
+
+    listingOnce sync.Once
+    listing     *template.Template
+    listingErr  error
+}
+
+// FileServer returns a handler serving the bundle (and the native OS file
+// system, as with Open) rooted at root.
+func FileServer(root Dir) *FileServerHandler {
+    return &FileServerHandler{ Root: root }
+}
+
+func (h *FileServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if len(h.ErrorPages) != 0 { w = &errorPageWriter{ ResponseWriter: w, h: h, r: r } }
+
+    upath := r.URL.Path
+    if !strings.HasPrefix(upath, "/") {
+        upath = "/" + upath
+        r.URL.Path = upath
+    }
+    name := path.Clean(upath)
+
+    // Redirect .../INDEX to .../ for index documents, as http.FileServer does
+    // for index.html.
+    if doc := path.Base(upath); strings.HasSuffix(upath, "/" + doc) && h.isIndexFile(doc) {
+        target := "./"
+        if r.URL.RawQuery != "" { target += "?" + r.URL.RawQuery }
+        w.Header().Set("Location", target)
+        w.WriteHeader(http.StatusMovedPermanently)
+        return
+    }
+
+    f, fi := h.openEntry(name)
+    if f != nil {
+        defer f.Close()
+        if fi.IsDir() {
+            h.serveDir(w, r, f, name)
+        } else if strings.HasSuffix(upath, "/") {
+            http.FileServer(h.Root).ServeHTTP(w, r)
+        } else {
+            h.serveFile(w, r, f, fi)
+        }
+        return
+    }
+
+    f, fi = h.openFingerprinted(w, name)
+    if f == nil { f, fi = h.openFallback(r, name) }
+    if f == nil {
+        http.FileServer(h.Root).ServeHTTP(w, r)
+        return
+    }
+    defer f.Close()
+
+    h.serveFile(w, r, f, fi)
+}
+
+// Open a file or directory, returning nil if it can't be.
+func (h *FileServerHandler) openEntry(name string) (http.File, os.FileInfo) {
+    f, err := h.Root.Open(name)
+    if err != nil { return nil, nil }
+
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, nil
+    }
+
+    return f, fi
+}
+
+// Open the fallback document for a path that doesn't exist (see Fallbacks).
+// Returns nil if there's none.
+func (h *FileServerHandler) openFallback(r *http.Request, name string) (http.File, os.FileInfo) {
+    if len(h.Fallbacks) == 0 || (r.Method != "GET" && r.Method != "HEAD") { return nil, nil }
+    if path.Ext(name) != "" { return nil, nil }
+
+    doc, match := "", ""
+    for prefix, d := range h.Fallbacks {
+        if !strings.HasPrefix(r.URL.Path, prefix) && name != path.Clean(prefix) { continue }
+        if len(prefix) > len(match) { doc, match = d, prefix }
+    }
+    if doc == "" { return nil, nil }
+
+    return h.open(doc)
+}
+
+// Serve a custom error page with the given status code. Returns false if the
+// page can't be opened.
+func (h *FileServerHandler) serveErrorPage(w http.ResponseWriter, r *http.Request, code int, page string) bool {
+    f, fi := h.open(page)
+    if f == nil { return false }
+    defer f.Close()
+
+    ctype := ""
+    if cf, ok := f.(*CaviarFile); ok { ctype = cf.obj.MimeType }
+    if ctype == "" { ctype = mime.TypeByExtension(path.Ext(fi.Name())) }
+    if ctype == "" { ctype = "text/html; charset=utf-8" }
+
+    // Drop whatever was set for the representation that failed.
+    for _, k := range []string{ "Content-Encoding", "Content-Range", "Etag", "Last-Modified", "Cache-Control" } {
+        w.Header().Del(k)
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+    w.WriteHeader(code)
+
+    if r.Method != "HEAD" { io.Copy(w, f) }
+    return true
+}
+
+// errorPageWriter swaps error responses for custom pages (see ErrorPages),
+// discarding the original body.
+type errorPageWriter struct {
+    http.ResponseWriter
+    h           *FileServerHandler
+    r           *http.Request
+    wroteHeader bool
+    replaced    bool
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+    if w.wroteHeader {
+        w.ResponseWriter.WriteHeader(code)
+        return
+    }
+    w.wroteHeader = true
+
+    if page, ok := w.h.ErrorPages[code]; ok {
+        w.replaced = w.h.serveErrorPage(w.ResponseWriter, w.r, code, page)
+        if w.replaced { return }
+    }
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+    if !w.wroteHeader { w.WriteHeader(http.StatusOK) }
+    if w.replaced { return len(b), nil }
+    return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the underlying writer's sendfile(2) fast path available.
+func (w *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+    if !w.wroteHeader { w.WriteHeader(http.StatusOK) }
+    if w.replaced { return io.Copy(ioutil.Discard, src) }
+    if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok { return rf.ReadFrom(src) }
+    return io.Copy(w.ResponseWriter, src)
+}
+
+// Open a plain file, returning nil if it isn't one (or doesn't exist).
+func (h *FileServerHandler) open(name string) (http.File, os.FileInfo) {
+    f, err := h.Root.Open(name)
+    if err != nil { return nil, nil }
+
+    fi, err := f.Stat()
+    if err != nil || fi.IsDir() {
+        f.Close()
+        return nil, nil
+    }
+
+    return f, fi
+}
+
+// Open a fingerprinted bundle file (see AssetURL()) and mark the response as
+// immutable. Returns nil if name isn't one.
+func (h *FileServerHandler) openFingerprinted(w http.ResponseWriter, name string) (http.File, os.FileInfo) {
+    orig, fp, ok := splitFingerprint(name)
+    if !ok { return nil, nil }
+
+    f, fi := h.open(orig)
+    if f == nil { return nil, nil }
+
+    if cf, ok := f.(*CaviarFile); !ok || cf.obj.Fingerprint != fp {
+        f.Close()
+        return nil, nil
+    }
+
+    w.Header().Set("Cache-Control", IMMUTABLE_CACHE_CONTROL)
+    return f, fi
+}
+
+// Serve a plain file, picking its gzip variant if it has one and the client
+// accepts it. Bundle files get a strong ETag derived from their SHA-256 hash, so
+// conditional requests are answered without touching the payload.
+func (h *FileServerHandler) serveFile(w http.ResponseWriter, r *http.Request, f http.File, fi os.FileInfo) {
+    cf, ok := f.(*CaviarFile)
+    if !ok {
+        http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+        return
+    }
+
+    gzipped := false
+    if cf.obj.GzipSize != 0 {
+        w.Header().Add("Vary", "Accept-Encoding")
+        if acceptsGzip(r) {
+            w.Header().Set("Content-Encoding", "gzip")
+            gzipped = true
+        }
+    }
+    content := newObjectContent(cf.obj, gzipped)
+
+    if _, haveTag := w.Header()["Etag"]; !haveTag {
+        if tag := objectETag(cf.obj, gzipped); tag != "" { w.Header().Set("ETag", tag) }
+    }
+
+    // The content type recorded at bundle time wins, so responses are the same
+    // on every host. Failing that, it must come from the file itself, as
+    // http.ServeContent would otherwise sniff the compressed data.
+    if _, haveType := w.Header()["Content-Type"]; !haveType {
+        ctype := cf.obj.MimeType
+        if ctype == "" { ctype = mime.TypeByExtension(path.Ext(fi.Name())) }
+        if ctype == "" && gzipped {
+            var buf [512]byte
+            n, _ := f.Read(buf[:])
+            ctype = http.DetectContentType(buf[:n])
+        }
+        if ctype != "" { w.Header().Set("Content-Type", ctype) }
+    }
+
+    http.ServeContent(&contentWriter{ w, content }, r, fi.Name(), fi.ModTime(), content)
+}
+
+// objectContent is the representation of a bundle file being served (its
+// plain or gzipped data), along with where it lives, so contentWriter can send
+// it without reading it through Read().
+type objectContent struct {
+    *io.SectionReader
+    // The data, if held in RAM.
+    data    []byte
+    // Otherwise, the external payload it's read from and its offset there.
+    ext     *filePayload
+    offset  int64
+}
+
+func newObjectContent(obj *Object, gzipped bool) *objectContent {
+    offset, size := obj.Offset, obj.Size
+    if gzipped { offset, size = obj.GzipOffset, obj.GzipSize }
+
+    c := new(objectContent)
+    if obj.External {
+        c.SectionReader = io.NewSectionReader(obj.ext, offset, size)
+        c.ext, _ = obj.ext.(*filePayload)
+        c.offset = offset
+    } else {
+        c.data = state.assets[offset:offset+size]
+        c.SectionReader = io.NewSectionReader(bytes.NewReader(c.data), 0, size)
+    }
+    return c
+}
+
+// contentWriter gives http.ServeContent's copy of an objectContent (made with
+// io.CopyN once preconditions and ranges are dealt with) a fast path: data
+// held in RAM is written in one go, and external data is handed to the
+// underlying writer's ReadFrom() as an *os.File, which lets *net.TCPConn use
+// sendfile(2). Anything else is copied as usual.
+type contentWriter struct {
+    http.ResponseWriter
+    content     *objectContent
+}
+
+func (w *contentWriter) ReadFrom(src io.Reader) (int64, error) {
+    lr, ok := src.(*io.LimitedReader)
+    if !ok || lr.R != io.Reader(w.content) { return io.Copy(w.ResponseWriter, src) }
+
+    pos, err := w.content.Seek(0, io.SeekCurrent)
+    if err != nil { return 0, err }
+    size := w.content.Size() - pos
+    if lr.N < size { size = lr.N }
+
+    var n int64
+    rf, ok := w.ResponseWriter.(io.ReaderFrom)
+    if w.content.data != nil {
+        m, werr := w.ResponseWriter.Write(w.content.data[pos:pos+size])
+        n, err = int64(m), werr
+    } else if ok && w.content.ext != nil {
+        n, err = sendPayload(rf, w.content.ext, w.content.offset + pos, size)
+    } else {
+        return io.Copy(w.ResponseWriter, src)
+    }
+
+    lr.N -= n
+    w.content.Seek(n, io.SeekCurrent)
+    return n, err
+}
+
+// Return a strong ETag for an object's plain or gzipped representation, based
+// on the SHA-256 hash of its contents. Returns an empty string for objects
+// bundled without one.
+func objectETag(obj *Object, gzipped bool) string {
+    if obj.Sha256 == "" { return "" }
+    tag := obj.Sha256
+    if gzipped { tag += "-gz" }
+    return `"` + tag + `"`
+}
+
+// Report whether the request's Accept-Encoding header allows gzip. An explicit
+// gzip entry takes precedence over a wildcard one.
+func acceptsGzip(r *http.Request) bool {
+    gzipq, anyq := -1.0, -1.0
+    for _, header := range r.Header["Accept-Encoding"] {
+        for _, coding := range strings.Split(header, ",") {
+            parts := strings.Split(coding, ";")
+            name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+            q := 1.0
+            for _, param := range parts[1:] {
+                param = strings.TrimSpace(param)
+                if !strings.HasPrefix(param, "q=") { continue }
+                v, err := strconv.ParseFloat(param[2:], 64)
+                if err == nil { q = v }
+            }
+
+            if name == "gzip" { gzipq = q }
+            if name == "*" { anyq = q }
+        }
+    }
+
+    if gzipq >= 0 { return gzipq > 0 }
+    return anyq > 0
+}
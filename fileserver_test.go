@@ -0,0 +1,313 @@
+package caviar
+
+import (
+    "compress/gzip"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// Files served in RAM and from the container file.
+var testServed = map[string]string{
+    "ram":      "/big.bin",
+    "external": "/ext/big.bin",
+}
+
+// Fetch a path from a server, optionally asking for a byte range.
+func testGet(t testing.TB, url, method, ranges string) (*http.Response, string) {
+    req, err := http.NewRequest(method, url, nil)
+    if err != nil { t.Fatal(err) }
+    if ranges != "" { req.Header.Set("Range", ranges) }
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil { t.Fatal(err) }
+    return resp, string(body)
+}
+
+func TestFileServerContent(t *testing.T) {
+    srv := httptest.NewServer(FileServer(Dir(testPrefix)))
+    defer srv.Close()
+
+    for kind, name := range testServed {
+        want := testFiles[name[1:]]
+
+        resp, body := testGet(t, srv.URL + name, "GET", "")
+        if resp.StatusCode != http.StatusOK || body != want {
+            t.Errorf("%v: GET got %v and %v bytes.", kind, resp.Status, len(body))
+        }
+
+        resp, body = testGet(t, srv.URL + name, "GET", "bytes=1000-200999")
+        if resp.StatusCode != http.StatusPartialContent || body != want[1000:201000] {
+            t.Errorf("%v: ranged GET got %v and %v bytes.", kind, resp.Status, len(body))
+        }
+
+        resp, body = testGet(t, srv.URL + name, "GET", "bytes=0-9,100-109")
+        if resp.StatusCode != http.StatusPartialContent || len(body) <= 20 {
+            t.Errorf("%v: multi-range GET got %v and %v bytes.", kind, resp.Status, len(body))
+        }
+
+        resp, body = testGet(t, srv.URL + name, "HEAD", "")
+        if resp.StatusCode != http.StatusOK || body != "" || resp.ContentLength != int64(len(want)) {
+            t.Errorf("%v: HEAD got %v and %v bytes.", kind, resp.Status, len(body))
+        }
+    }
+}
+
+func TestFileServerETag(t *testing.T) {
+    srv := httptest.NewServer(FileServer(Dir(testPrefix)))
+    defer srv.Close()
+
+    resp, _ := testGet(t, srv.URL + "/index.html", "GET", "")
+    obj, err := lookupObject("index.html")
+    if err != nil { t.Fatal(err) }
+    tag := resp.Header.Get("ETag")
+    if tag != `"` + obj.Sha256 + `"` { t.Fatalf("Got ETag %v.", tag) }
+
+    req, err := http.NewRequest("GET", srv.URL + "/index.html", nil)
+    if err != nil { t.Fatal(err) }
+    req.Header.Set("If-None-Match", tag)
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotModified { t.Fatalf("Revalidation got %v.", resp.Status) }
+}
+
+func BenchmarkFileServer(b *testing.B) {
+    handlers := map[string]http.Handler{
+        "caviar":   FileServer(Dir(testPrefix)),
+        "net-http": http.FileServer(Dir(testPrefix)),
+    }
+
+    for hname, h := range handlers {
+        srv := httptest.NewServer(h)
+        for kind, name := range testServed {
+            b.Run(hname + "/" + kind, func(b *testing.B) {
+                b.SetBytes(int64(len(testFiles[name[1:]])))
+                for i := 0; i < b.N; i++ {
+                    resp, err := http.Get(srv.URL + name)
+                    if err != nil { b.Fatal(err) }
+                    io.Copy(ioutil.Discard, resp.Body)
+                    resp.Body.Close()
+                }
+            })
+        }
+        srv.Close()
+    }
+}
+
+func TestFileServerIndexRedirect(t *testing.T) {
+    client := &http.Client{ CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    } }
+
+    for _, c := range []struct {
+        index   []string
+        status  int
+    }{
+        { nil, http.StatusMovedPermanently },
+        { []string{ "default.html" }, http.StatusOK },
+        { []string{}, http.StatusOK },
+    } {
+        h := FileServer(Dir(testPrefix))
+        h.IndexFiles = c.index
+        h.DisableListing = true
+        srv := httptest.NewServer(h)
+
+        resp, err := client.Get(srv.URL + "/index.html")
+        srv.Close()
+        if err != nil { t.Fatal(err) }
+        resp.Body.Close()
+
+        if resp.StatusCode != c.status {
+            t.Errorf("IndexFiles %q: got %v, want %v.", c.index, resp.Status, c.status)
+        }
+    }
+}
+
+// Site served by the tests below. Scripts have gzip variants (see
+// testBundle()).
+var testSite = map[string]string{
+    "index.html":   "<html>app</html>",
+    "404.html":     "<html>not found</html>",
+    "app.js":       strings.Repeat("console.log('in RAM');\n", 100),
+    "ext/app.js":   strings.Repeat("console.log('external');\n", 100),
+}
+
+// Write a bundle of testSite (see testBundle() for edit) and return its path.
+func testSiteBundle(t *testing.T, edit ...func(*Manifest)) string {
+    data, _, err := testBundle("", testSite, edit...)
+    if err != nil { t.Fatal(err) }
+    name := filepath.Join(t.TempDir(), "site." + CAVIAR_EXTENSION)
+    err = ioutil.WriteFile(name, data, 0644)
+    if err != nil { t.Fatal(err) }
+    return name
+}
+
+// Serve a bundle of testSite with a FileServer (configured by setup, if not
+// nil) and call f with the server's URL.
+func testWithSite(t *testing.T, setup func(*FileServerHandler), f func(url string), edit ...func(*Manifest)) {
+    testWithBundle(t, testSiteBundle(t, edit...), func() {
+        h := FileServer(Dir(state.prefix))
+        if setup != nil { setup(h) }
+        srv := httptest.NewServer(h)
+        defer srv.Close()
+        f(srv.URL)
+    })
+}
+
+// Fetch a path from a server with the given Accept-Encoding, leaving the
+// response body as sent.
+func testGetEncoded(t *testing.T, url, encoding string) (*http.Response, string) {
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil { t.Fatal(err) }
+    req.Header.Set("Accept-Encoding", encoding)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(err) }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil { t.Fatal(err) }
+    return resp, string(body)
+}
+
+func TestFileServerGzip(t *testing.T) {
+    testWithSite(t, nil, func(url string) {
+        for _, name := range []string{ "app.js", "ext/app.js" } {
+            resp, body := testGetEncoded(t, url + "/" + name, "gzip")
+            if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+                t.Fatalf("%v: gzip GET got %v, Content-Encoding %q.", name, resp.Status, resp.Header.Get("Content-Encoding"))
+            }
+            zr, err := gzip.NewReader(strings.NewReader(body))
+            if err != nil { t.Fatal(err) }
+            data, err := ioutil.ReadAll(zr)
+            if err != nil || string(data) != testSite[name] { t.Fatalf("%v: gzip body decompressed to %v bytes, %v.", name, len(data), err) }
+
+            resp, body = testGetEncoded(t, url + "/" + name, "identity")
+            if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" || body != testSite[name] {
+                t.Fatalf("%v: plain GET got %v, Content-Encoding %q.", name, resp.Status, resp.Header.Get("Content-Encoding"))
+            }
+
+            // Both representations must tell caches they depend on it.
+            for _, encoding := range []string{ "gzip", "identity" } {
+                resp, _ = testGetEncoded(t, url + "/" + name, encoding)
+                if resp.Header.Get("Vary") != "Accept-Encoding" {
+                    t.Errorf("%v: %v GET got Vary %q.", name, encoding, resp.Header.Get("Vary"))
+                }
+                if ctype := resp.Header.Get("Content-Type"); !strings.HasPrefix(ctype, "text/javascript") {
+                    t.Errorf("%v: %v GET got Content-Type %q.", name, encoding, ctype)
+                }
+            }
+        }
+
+        resp, _ := testGetEncoded(t, url + "/index.html", "gzip")
+        if resp.Header.Get("Vary") != "" || resp.Header.Get("Content-Encoding") != "" {
+            t.Errorf("File without a gzip variant got Vary %q.", resp.Header.Get("Vary"))
+        }
+    })
+}
+
+func TestFileServerGzipChecksum(t *testing.T) {
+    corrupt := func(name string) func(*Manifest) {
+        return func(m *Manifest) { testObject(&m.ObjectRoot, name).GzipChecksum ^= 1 }
+    }
+
+    // Variants held in RAM are checked when the bundle is loaded...
+    saved := state
+    state = caviarState{}
+    name := testSiteBundle(t, corrupt("app.js"))
+    err := loadTestBundle(name, filepath.Join(filepath.Dir(name), "assets"))
+    for _, f := range state.files { f.Close() }
+    state = saved
+    if err == nil { t.Fatal("Loaded bundle with a corrupt gzip variant.") }
+
+    // ...and external ones when first opened.
+    testWithSite(t, nil, func(url string) {
+        for _, encoding := range []string{ "gzip", "identity" } {
+            resp, _ := testGetEncoded(t, url + "/ext/app.js", encoding)
+            if resp.StatusCode != http.StatusInternalServerError {
+                t.Errorf("%v GET of a file with a corrupt gzip variant got %v.", encoding, resp.Status)
+            }
+        }
+    }, corrupt("ext/app.js"))
+}
+
+func TestFileServerFallbacks(t *testing.T) {
+    setup := func(h *FileServerHandler) { h.Fallbacks = map[string]string{ "/app/": "/index.html" } }
+    testWithSite(t, setup, func(url string) {
+        for _, c := range []struct {
+            method, path    string
+            status          int
+        }{
+            { "GET", "/app/route", http.StatusOK },
+            { "HEAD", "/app/route", http.StatusOK },
+            { "GET", "/app/v1.2/route", http.StatusOK },
+            { "GET", "/app/app.js", http.StatusNotFound },
+            { "GET", "/app/missing.js", http.StatusNotFound },
+            { "GET", "/app/logo.min.svg", http.StatusNotFound },
+            { "POST", "/app/route", http.StatusNotFound },
+            { "GET", "/other/route", http.StatusNotFound },
+        } {
+            resp, body := testGet(t, url + c.path, c.method, "")
+            if resp.StatusCode != c.status {
+                t.Errorf("%v %v: got %v, want %v.", c.method, c.path, resp.Status, c.status)
+            }
+            if c.status == http.StatusOK && c.method == "GET" && body != testSite["index.html"] {
+                t.Errorf("%v %v: got %q.", c.method, c.path, body)
+            }
+        }
+    })
+}
+
+func TestFileServerErrorPages(t *testing.T) {
+    setup := func(h *FileServerHandler) { h.ErrorPages = map[int]string{ 404: "/404.html" } }
+    testWithSite(t, setup, func(url string) {
+        for _, method := range []string{ "GET", "HEAD" } {
+            resp, body := testGet(t, url + "/missing", method, "")
+            want := testSite["404.html"]
+            if method == "HEAD" { want = "" }
+
+            if resp.StatusCode != http.StatusNotFound || body != want {
+                t.Errorf("%v: got %v, %q.", method, resp.Status, body)
+            }
+            if ctype := resp.Header.Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+                t.Errorf("%v: got Content-Type %q.", method, ctype)
+            }
+            if resp.ContentLength != int64(len(testSite["404.html"])) {
+                t.Errorf("%v: got Content-Length %v.", method, resp.ContentLength)
+            }
+        }
+
+        // Other statuses are left alone.
+        resp, body := testGet(t, url + "/index.html", "GET", "bytes=1000-")
+        if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || body == testSite["404.html"] {
+            t.Errorf("Unsatisfiable range got %v, %q.", resp.Status, body)
+        }
+    })
+}
+
+func TestFileServerMimeType(t *testing.T) {
+    // Recorded types win over extensions, for both representations.
+    setType := func(m *Manifest) {
+        testObject(&m.ObjectRoot, "app.js").MimeType = "application/x-recorded"
+        testObject(&m.ObjectRoot, "ext/app.js").MimeType = "application/x-recorded"
+    }
+    testWithSite(t, nil, func(url string) {
+        for _, name := range []string{ "app.js", "ext/app.js" } {
+            for _, encoding := range []string{ "gzip", "identity" } {
+                resp, _ := testGetEncoded(t, url + "/" + name, encoding)
+                if ctype := resp.Header.Get("Content-Type"); ctype != "application/x-recorded" {
+                    t.Errorf("%v: %v GET got Content-Type %q.", name, encoding, ctype)
+                }
+            }
+        }
+    }, setType)
+}
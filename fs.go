@@ -0,0 +1,85 @@
+// fs.go implements the io/fs interfaces on top of the bundle, so it can be used
+// with http.FS, template.ParseFS, fs.WalkDir and friends.
+
+package caviar
+
+import (
+    "io/fs"
+    "path"
+)
+
+// caviarFS implements fs.FS and its optional extensions for the bundle subtree
+// rooted at dir (a slash-separated path relative to the object root).
+type caviarFS struct {
+    dir string
+}
+
+// FS returns an fs.FS serving the bundle's contents, rooted at the asset root.
+// Unlike Open, it never falls back to the native OS, and it ignores the
+// writable overlay.
+func FS() fs.FS {
+    return caviarFS{ "." }
+}
+
+// Sub returns an fs.FS serving the bundle subtree rooted at dir.
+func Sub(dir string) (fs.FS, error) {
+    return caviarFS{ "." }.Sub(dir)
+}
+
+// Resolve a name relative to the file system's root to its Object.
+func (fsys caviarFS) object(op, name string) (*Object, error) {
+    if !fs.ValidPath(name) {
+        return nil, pathError(op, name, fs.ErrInvalid)
+    }
+    obj, err := lookupObject(path.Join(fsys.dir, name))
+    if err != nil { return nil, pathError(op, name, err) }
+    return obj, nil
+}
+
+// Open implements fs.FS.
+func (fsys caviarFS) Open(name string) (fs.File, error) {
+    obj, err := fsys.object("open", name)
+    if err != nil { return nil, err }
+    if err := verifyExternal(obj); err != nil { return nil, pathError("open", name, err) }
+    return &CaviarFile{ obj: obj, name: name, fd: genFd(obj) }, nil
+}
+
+// Stat implements fs.StatFS.
+func (fsys caviarFS) Stat(name string) (fs.FileInfo, error) {
+    obj, err := fsys.object("stat", name)
+    if err != nil { return nil, err }
+    return &CaviarFileInfo{ obj }, nil
+}
+
+// ReadFile implements fs.ReadFileFS. The returned slice is a copy, so callers
+// are free to modify it.
+func (fsys caviarFS) ReadFile(name string) ([]byte, error) {
+    obj, err := fsys.object("open", name)
+    if err != nil { return nil, err }
+    return readObject(obj, name)
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (fsys caviarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+    obj, err := fsys.object("open", name)
+    if err != nil { return nil, err }
+    if !obj.ModeBits.IsDir() {
+        return nil, pathError("readdirent", name, fs.ErrInvalid)
+    }
+
+    return dirEntries(obj), nil
+}
+
+// Glob implements fs.GlobFS.
+func (fsys caviarFS) Glob(pattern string) ([]string, error) {
+    // Hide our own Glob method from fs.Glob, lest it calls us right back.
+    return fs.Glob(struct{ fs.ReadDirFS }{ fsys }, pattern)
+}
+
+// Sub implements fs.SubFS.
+func (fsys caviarFS) Sub(dir string) (fs.FS, error) {
+    if !fs.ValidPath(dir) {
+        return nil, pathError("sub", dir, fs.ErrInvalid)
+    }
+    return caviarFS{ path.Join(fsys.dir, dir) }, nil
+}
@@ -0,0 +1,19 @@
+package caviar
+
+import (
+    "testing"
+    "testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+    err := fstest.TestFS(FS(), "index.html", "empty.txt", "emptydir", "sub/a.txt", "sub/deeper/b.txt")
+    if err != nil { t.Fatal(err) }
+}
+
+func TestSub(t *testing.T) {
+    sub, err := Sub("sub")
+    if err != nil { t.Fatal(err) }
+
+    err = fstest.TestFS(sub, "a.txt", "deeper/b.txt")
+    if err != nil { t.Fatal(err) }
+}
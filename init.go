@@ -5,12 +5,14 @@ package caviar
 import (
     "bitbucket.org/kardianos/osext"
     "archive/zip"
+    "debug/elf"
     "encoding/gob"
     "io"
     "io/ioutil"
     "errors"
     "path"
     "fmt"
+    "os"
 )
 
 // Global state
@@ -19,13 +21,82 @@ type caviarState struct {
     assets      []byte
     ready       bool
     prefix      string
+    // Digest of the base bundle. Every patch applied on top of it must
+    // reference it.
+    digest      string
+    // Whether the base bundle passed verifyManifest(). Patches are only
+    // applied once they pass it too. External objects are checked separately
+    // (see verifyExternal()).
+    verified    bool
+    // Digests and file names of all applied patches, in the order they were
+    // applied.
+    patches     []string
+    patchfiles  []string
+    // Container files kept open to serve external objects from.
+    files       []*os.File
+    // Which side wins when merging directory listings. See SetPrecedence().
+    precedence  int
+    // Container file the bundle was loaded from and where in it (see
+    // CONTAINER_* constants).
+    source      string
+    kind        string
+    // Why Init() failed, if it did.
+    err         error
+    // Mount table, longest target first. The asset root is mounted at prefix.
+    mounts      []Mount
+    // Writable overlay's upper layer. Nil unless EnableOverlay() was called.
+    overlay     layer
+    // URL prefix and bundle directory for AssetURL(). See SetAssetBase().
+    assetURL    string
+    assetDir    string
+    // Virtual working directory, or empty to use the process'. See Chdir().
+    cwd         string
+}
+
+// A container loaded from disk.
+type container struct {
+    manifest    *Manifest
+    assets      []byte
+    // External payload (External.bin) and the file it's read from. Both are
+    // nil if the container holds no external objects.
+    external    *io.SectionReader
+    file        *os.File
+    // Where the container was found: CONTAINER_ATTACHED, CONTAINER_ELF or
+    // CONTAINER_DETACHED.
+    kind        string
+    // Offset of the external payload within file.
+    extbase     int64
+}
+
+// External payload of a container. Besides reading it in place, the file and
+// offset it lives at allow handing it straight to sendfile(2) (see
+// CaviarFile.WriteTo()).
+type filePayload struct {
+    *io.SectionReader
+    file        *os.File
+    base        int64
 }
 
 var state caviarState
 
-// Init sets up Caviar's internal state and loads the bundle, if any.
+// Where a container was found.
+const (
+    // Appended to the executable.
+    CONTAINER_ATTACHED = "attached"
+    // In the executable's ELF_SECTION section.
+    CONTAINER_ELF = "elf"
+    // In a detached container file next to the executable (see
+    // DetachedName()).
+    CONTAINER_DETACHED = "detached"
+    // In a container file downloaded by LoadURL(). The source is the URL.
+    CONTAINER_URL = "url"
+)
+
+// Init sets up Caviar's internal state and loads the bundle, if any, along
+// with any patch bundles found next to the executable (see PatchNames()).
 func Init() (err error) {
-    if state.ready { return debug(errors.New("Already initialized.")) }
+    if state.ready { return debug(ErrAlreadyLoaded) }
+    defer func() { state.err = err }()
 
     // Setup global state
     state.prefix, err = osext.Executable()
@@ -33,60 +104,191 @@ func Init() (err error) {
     state.prefix = path.Dir(state.prefix)
 
     // Load ZIP container
-    path, err := osext.Executable()
+    exe, err := osext.Executable()
     if err != nil { return debug(err) }
 
-    reader, err := zip.OpenReader(path)
+    source := exe
+    c, err := openContainer(source)
     if err != nil {
-        reader, err = zip.OpenReader(DetachedName(path))
+        source = DetachedName(exe)
+        c, err = openContainer(source)
         if err != nil { return debug(err) }
+        c.kind = CONTAINER_DETACHED
     }
-    defer reader.Close()
-
-    // Load manifest
-    m, err := getFile(reader, "Manifest.gob")
+    err = loadContainer(c, source, c.kind)
     if err != nil { return debug(err) }
 
-    dec := gob.NewDecoder(m)
-    err = dec.Decode(&state.manifest)
+    // Apply patches
+    patches, err := PatchNames(exe)
     if err != nil { return debug(err) }
 
+    for _, p := range patches {
+        err = applyPatch(p)
+        if err != nil {
+            for _, f := range state.files { f.Close() }
+            state.manifest = Manifest{}
+            state.verified = false
+            state.assets = nil
+            state.patches = nil
+            state.patchfiles = nil
+            state.files = nil
+            state.mounts = nil
+            return debug(err)
+        }
+    }
+
+    // All done
+    debug("Caviar is ready.")
+    debug(fmt.Sprintf("Loaded %v bytes.", PayloadSize()))
+    state.ready = true
+    return nil
+}
+
+// Load a freshly opened base bundle container into the global state. The
+// container is closed if it can't be used.
+func loadContainer(c *container, source, kind string) error {
+    state.source, state.kind = source, kind
+    state.manifest = *c.manifest
+
+    if state.manifest.BaseDigest != "" {
+        c.close()
+        return pathError("load", source, ErrPatchBundle)
+    }
+
     // Process bundle options
     if state.manifest.Options.CustomPrefix != "" {
         state.prefix = state.manifest.Options.CustomPrefix
     }
 
+    setMount(Mount{ ".", state.prefix })
+    for _, m := range state.manifest.Options.Mounts { setMount(m) }
+
     if state.manifest.Options.ExtractionMode != EXTRACT_MEMORY {
+        c.close()
         return debug(errors.New("Unsupported extraction mode: only EXTRACT_MEMORY is currently supported."))
     }
 
+    // Verify manifest
+    err := verifyManifest(&state.manifest, c.assets, c.external)
+    if err != nil {
+        c.close()
+        return debug(err)
+    }
+
+    state.verified = true
+    state.assets = c.assets
+    state.digest = Digest(&state.manifest, state.assets)
+    attachExternal(&state.manifest.ObjectRoot, c.payload())
+    if c.file != nil { state.files = append(state.files, c.file) }
+
+    // Patch object root with correct basename.
+    state.manifest.ObjectRoot.Name = path.Base(state.prefix)
+    return nil
+}
+
+// Open a container file and load its manifest and asset payload. The file is
+// kept open only if the container holds external objects. Verification is left
+// up to the caller.
+func openContainer(name string) (_ *container, err error) {
+    c := new(container)
+    c.file, err = os.Open(name)
+    if err != nil { return nil, debug(err) }
+    defer func() {
+        if err != nil || c.external == nil { c.close() }
+    }()
+
+    // Locate the container: an ELF section takes precedence over a ZIP
+    // appended to (or making up) the file.
+    base, size, section, err := findContainer(c.file)
+    if err != nil { return nil, debug(err) }
+    c.kind = CONTAINER_ATTACHED
+    if section { c.kind = CONTAINER_ELF }
+
+    reader, err := zip.NewReader(io.NewSectionReader(c.file, base, size), size)
+    if err != nil { return nil, debug(err) }
+
+    // Load manifest
+    m, err := getFile(reader, "Manifest.gob")
+    if err != nil { return nil, debug(err) }
+
+    c.manifest = new(Manifest)
+    dec := gob.NewDecoder(m)
+    err = dec.Decode(c.manifest)
+    if err != nil { return nil, debug(err) }
+
     // Load assets
     // TODO: account for extraction mode
     a, err := getFile(reader, "Assets.bin")
-    if err != nil { return debug(err) }
+    if err != nil { return nil, debug(err) }
 
-    state.assets, err = ioutil.ReadAll(a)
-    if err != nil {
-        state.assets = nil
-        return debug(err)
+    c.assets, err = ioutil.ReadAll(a)
+    if err != nil { return nil, debug(err) }
+
+    // Locate external payload, if any. It must be stored uncompressed so it
+    // can be read in place.
+    for _, f := range reader.File {
+        if f.Name != "External.bin" { continue }
+        if f.Method != zip.Store {
+            return nil, debug(errors.New("External payload must be stored uncompressed."))
+        }
+        offset, err := f.DataOffset()
+        if err != nil { return nil, debug(err) }
+        c.extbase = base + offset
+        c.external = io.NewSectionReader(c.file, c.extbase, int64(f.UncompressedSize64))
     }
 
-    // Verify manifest
-    err = verifyManifest()
-    if err != nil {
-        state.assets = nil
-        return debug(err)
+    return c, nil
+}
+
+// Return the offset and size of the container within a file, and whether it
+// lives in an ELF section.
+func findContainer(file *os.File) (offset, size int64, section bool, err error) {
+    if ef, err := elf.NewFile(file); err == nil {
+        s := ef.Section(ELF_SECTION)
+        if s != nil && s.Type != elf.SHT_NOBITS {
+            return int64(s.Offset), int64(s.Size), true, nil
+        }
     }
 
-    // All done
-    debug("Caviar is ready.")
-    debug(fmt.Sprintf("Loaded %v bytes.", PayloadSize()))
-    state.ready = true
-    return nil
+    fi, err := file.Stat()
+    if err != nil { return 0, 0, false, debug(err) }
+    return 0, fi.Size(), false, nil
+}
+
+// FindContainer returns the part of a file holding its container: its
+// ELF_SECTION section if it has one, or else the whole file (ZIP readers find
+// containers appended to executables from the end, and detached containers
+// make up the whole file). It's how Init() locates containers.
+func FindContainer(file *os.File) (*io.SectionReader, error) {
+    offset, size, _, err := findContainer(file)
+    if err != nil { return nil, err }
+    return io.NewSectionReader(file, offset, size), nil
+}
+
+// Release the container's file. External objects can't be read afterwards.
+func (c *container) close() {
+    if c.file == nil { return }
+    c.file.Close()
+    c.file = nil
+    c.external = nil
+}
+
+// Return the container's external payload, or nil if there's none.
+func (c *container) payload() io.ReaderAt {
+    if c.external == nil { return nil }
+    return &filePayload{ c.external, c.file, c.extbase }
+}
+
+// Recursively point external objects to the payload they should be read from.
+func attachExternal(obj *Object, ext io.ReaderAt) {
+    if obj.External { obj.ext, obj.check = ext, new(extCheck) }
+    for i := 0; i < len(obj.Objects); i++ {
+        attachExternal(&obj.Objects[i], ext)
+    }
 }
 
 // Find file inside a ZIP container.
-func getFile(reader *zip.ReadCloser, name string) (io.Reader, error) {
+func getFile(reader *zip.Reader, name string) (io.Reader, error) {
     for _, f := range reader.File {
         if f.Name != name { continue }
         r, err := f.Open()
@@ -4,15 +4,60 @@ package caviar
 
 import (
     "os"
-    "errors"
+    "io/ioutil"
+    "syscall"
 )
 
-// TODO
+// ReadFile mimicks ioutil.ReadFile() (and os.ReadFile()). Files outside the
+// bundle are read through the os package.
 func ReadFile(filename string) ([]byte, error) {
-    return nil, debug(errors.New("ReadFile(): Not Implemented."))
+    if data, ok, err := readUpper(filename); ok { return data, err }
+    obj, err := findObject(filename)
+    if err != nil { return ioutil.ReadFile(nativePath(filename)) }
+    return readObject(obj, filename)
 }
 
-// TODO
+// ReadFileNoCopy behaves like ReadFile, except that for files held in RAM it
+// returns the bundle's own payload slice rather than a copy of it, which makes
+// it cheap enough to call on every request. The returned slice MUST NOT be
+// modified. Files not held in RAM (see BundleOptions.ExternalThreshold) and
+// files outside the bundle are read into a fresh slice.
+func ReadFileNoCopy(filename string) ([]byte, error) {
+    if data, ok, err := readUpper(filename); ok { return data, err }
+    obj, err := findObject(filename)
+    if err != nil { return ioutil.ReadFile(nativePath(filename)) }
+
+    if obj.ModeBits.IsDir() {
+        return nil, pathError("read", filename, syscall.EISDIR)
+    }
+    if obj.External { return readObject(obj, filename) }
+    if obj.Size == 0 { return []byte{}, nil }
+
+    data, err := getPayload(obj)
+    if err != nil { return nil, pathError("read", filename, err) }
+    return data[:len(data):len(data)], nil
+}
+
+// ReadDir mimicks ioutil.ReadDir(). For directories that exist both in the
+// bundle and on disk, the listing merges both, as Readdir() does. Directories
+// outside the bundle are read through the os package.
 func ReadDir(dirname string) ([]os.FileInfo, error) {
-    return nil, debug(errors.New("ReadFile(): Not Implemented."))
+    return readDirMerged(dirname)
+}
+
+// Read a file object's contents into a fresh slice.
+func readObject(obj *Object, name string) ([]byte, error) {
+    if obj.ModeBits.IsDir() {
+        return nil, pathError("read", name, syscall.EISDIR)
+    }
+
+    data := make([]byte, obj.Size)
+    if obj.Size == 0 { return data, nil }
+
+    r, err := getPayloadReader(obj)
+    if err != nil { return nil, pathError("read", name, err) }
+    _, err = r.ReadAt(data, 0)
+    if err != nil { return nil, pathError("read", name, err) }
+
+    return data, nil
 }
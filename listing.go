@@ -0,0 +1,137 @@
+// listing.go implements FileServer's directory handling: index documents and
+// templated directory listings.
+
+package caviar
+
+import (
+    "bytes"
+    "html/template"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "sort"
+)
+
+// Index documents FileServer looks for by default.
+var DEFAULT_INDEX_FILES = []string{ "index.html" }
+
+// Listing is what listing templates are executed with (see
+// FileServerHandler.ListingTemplate).
+type Listing struct {
+    // URL path of the directory.
+    Path    string
+    // Directory entries, sorted by name.
+    Entries []ListingEntry
+}
+
+// ListingEntry is a directory entry in a Listing.
+type ListingEntry struct {
+    os.FileInfo
+    // Link to the entry, relative to the directory. Directories get a
+    // trailing slash.
+    URL     string
+}
+
+// Mimicks http.FileServer's own listing.
+var defaultListing = template.Must(template.New("listing").Parse(`<!doctype html>
+<meta name="viewport" content="width=device-width">
+<pre>
+{{range .Entries}}<a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a>
+{{end}}</pre>
+`))
+
+// Return the index documents in effect (see IndexFiles).
+func (h *FileServerHandler) indexFiles() []string {
+    if h.IndexFiles == nil { return DEFAULT_INDEX_FILES }
+    return h.IndexFiles
+}
+
+// Report whether a file name is one of the index documents in effect.
+func (h *FileServerHandler) isIndexFile(name string) bool {
+    for _, doc := range h.indexFiles() {
+        if doc == name { return true }
+    }
+    return false
+}
+
+// Serve a directory: its index document if it has one, or its listing. name is
+// the directory's clean URL path.
+func (h *FileServerHandler) serveDir(w http.ResponseWriter, r *http.Request, d http.File, name string) {
+    // Let http.FileServer redirect to the canonical .../ URL
+    if name != "/" && r.URL.Path[len(r.URL.Path)-1] != '/' {
+        http.FileServer(h.Root).ServeHTTP(w, r)
+        return
+    }
+
+    for _, doc := range h.indexFiles() {
+        f, fi := h.open(path.Join(name, doc))
+        if f == nil { continue }
+        defer f.Close()
+        h.serveFile(w, r, f, fi)
+        return
+    }
+
+    if h.DisableListing {
+        http.NotFound(w, r)
+        return
+    }
+
+    tmpl, err := h.listingTemplate()
+    if err != nil {
+        debug(err)
+        http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+
+    list, err := d.Readdir(-1)
+    if err != nil {
+        http.Error(w, "Error reading directory", http.StatusInternalServerError)
+        return
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+    listing := &Listing{ Path: name }
+    for _, fi := range list {
+        link := url.URL{ Path: fi.Name() }
+        if fi.IsDir() { link.Path += "/" }
+        listing.Entries = append(listing.Entries, ListingEntry{ fi, link.String() })
+    }
+
+    var buf bytes.Buffer
+    err = tmpl.Execute(&buf, listing)
+    if err != nil {
+        debug(err)
+        http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    if r.Method != "HEAD" { w.Write(buf.Bytes()) }
+}
+
+// Return the listing template, loading it from ListingTemplate on first use.
+func (h *FileServerHandler) listingTemplate() (*template.Template, error) {
+    if h.ListingTemplate == "" { return defaultListing, nil }
+
+    h.listingOnce.Do(func() {
+        f, err := h.Root.Open(h.ListingTemplate)
+        if err != nil {
+            h.listingErr = err
+            return
+        }
+        defer f.Close()
+
+        data, err := ioutil.ReadAll(f)
+        if err != nil {
+            h.listingErr = err
+            return
+        }
+
+        name := path.Base(h.ListingTemplate)
+        h.listing, h.listingErr = template.New(name).Funcs(FuncMap()).Parse(string(data))
+    })
+
+    return h.listing, h.listingErr
+}
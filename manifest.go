@@ -8,8 +8,12 @@ import (
     "fmt"
     "errors"
     "os"
-    "path"
+    "io"
+    "sync"
+    "sync/atomic"
     "hash/crc32"
+    "crypto/sha256"
+    "encoding/hex"
 )
 
 // Manifest-level magic value
@@ -42,6 +46,21 @@ type Manifest struct {
     Options         BundleOptions
     // The root directory object.
     ObjectRoot      Object
+    // Hex-encoded SHA-256 digest of the bundle's contents as computed by
+    // Digest(). Bundles created by older versions of cavundle leave it empty.
+    Digest          string
+    // Patch bundles set this to the Digest of the base bundle they apply to.
+    // It must be left empty for regular (full) bundles.
+    BaseDigest      string
+}
+
+// Mount maps a bundle subtree to an absolute path.
+type Mount struct {
+    // Slash-separated path of the subtree relative to the object root, or "."
+    // for the whole bundle.
+    Source  string
+    // Absolute path the subtree shows up at.
+    Target  string
 }
 
 // Various options to be set by the program creating the bundle. They will
@@ -52,10 +71,21 @@ type BundleOptions struct {
     // that happens to be if CustomPrefix is set to anything other than an
     // empty string.
     CustomPrefix    string
+    // Additional places bundle subtrees show up at, on top of the asset root
+    // at the prefix above (i.e. “etc” at “/etc/myprogram”). See AddMount().
+    Mounts          []Mount
     // This will make Caviar print out various log messages to the terminal.
     Debug           bool
     // See EXTRACT_* constants above.
     ExtractionMode  int
+    // Files larger than this many bytes are not loaded to RAM but read from
+    // the container file on demand (see Object.External). Set to 0 to load
+    // everything to RAM.
+    ExternalThreshold   int64
+    // Set when the bundle was created with extended metadata (nanosecond
+    // modification times, ownership and extended attributes).
+    // Without it, those Object fields are left at their zero values.
+    ExtendedMeta    bool
 }
 
 // Object represents either a file or a directory inside the bundle.
@@ -67,8 +97,10 @@ type Object struct {
     // FileMode as returned by os.File.Stat(). Note that os.ModeDir must be set
     // if the object represents a directory.
     ModeBits    os.FileMode
-    // Modification time.
+    // Modification time (seconds since the UNIX epoch).
     ModTime     int64
+    // Nanosecond part of the modification time.
+    ModTimeNsec int64
     // Size of the file. Set to 0 for directories.
     Size        int64
     // All assets inside a bundle are packed inside a single flat binary file
@@ -79,49 +111,129 @@ type Object struct {
     Offset      int64
     // CRC32 checksum for the file's contents. Set to 0 for directories.
     Checksum    uint32
+    // Short content hash used to build cache-busting URLs (see AssetURL()).
+    // Empty for directories.
+    Fingerprint string
+    // Hex-encoded SHA-256 hash of the file's contents, used as FileServer's
+    // ETag. Empty for directories.
+    Sha256      string
+    // Numeric owner and group IDs of the original file.
+    Uid         int
+    Gid         int
+    // MIME type determined when the bundle was created (see cavundle's
+    // -mimetypes option), served as the Content-Type by FileServer. Empty for
+    // directories and files of unknown type.
+    MimeType    string
+    // Extended attributes of the original file, sorted by name.
+    Xattrs      []Xattr
+    // Arbitrary user-supplied key/value pairs, sorted by key.
+    Tags        []Tag
+    // External objects have their payload stored uncompressed in the
+    // container's External.bin file rather than in Assets.bin, and Offset is
+    // relative to the former. Their data is read straight from the container
+    // file rather than kept in RAM.
+    External    bool
+    // Precompressed gzip variant of the file (see FileServer()), stored next
+    // to its payload, in Assets.bin or External.bin alike, and the CRC32
+    // checksum of its (compressed) contents. All are set to 0 if there's none.
+    GzipOffset  int64
+    GzipSize    int64
+    GzipChecksum    uint32
+    // Only used in patch bundles: marks an object that has been deleted from
+    // the base bundle. Whiteout objects have no payload nor children.
+    Whiteout    bool
     // Child objects (sub-directories and contained files). File objects must
     // not have any children.
     Objects     []Object
+    // Where to read the payload of External objects from, and whether it has
+    // been checked yet. Set at runtime.
+    ext         io.ReaderAt
+    check       *extCheck
+}
+
+// Xattr is a single extended attribute recorded for an Object.
+type Xattr struct {
+    Name        string
+    Value       []byte
 }
 
-// Perform various sanity checks on the manifest and contained object tree.
-func verifyManifest() (error) {
+// Tag is a single user-supplied key/value pair recorded for an Object.
+type Tag struct {
+    Key         string
+    Value       string
+}
+
+// Digest computes the SHA-256 digest of a bundle's contents, that is, its
+// object tree and in-memory asset payload (external payloads are covered by
+// their checksums only). It's used to tie patch bundles to the base
+// bundle they were generated from.
+func Digest(m *Manifest, assets []byte) string {
+    h := sha256.New()
+    fmt.Fprintf(h, "%s\x00%s\n", m.Magic, m.BaseDigest)
+    digestObject(h, &m.ObjectRoot)
+    h.Write(assets)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// Recursively feed an object's description into a digest.
+func digestObject(w io.Writer, obj *Object) {
+    fmt.Fprintf(w, "%q %o %d %d %d %x %t %t {\n", obj.Name, uint32(obj.ModeBits),
+        obj.ModTime, obj.Size, obj.Offset, obj.Checksum, obj.External, obj.Whiteout)
+    if obj.GzipSize != 0 { fmt.Fprintf(w, "gzip %d %d %x\n", obj.GzipOffset, obj.GzipSize, obj.GzipChecksum) }
+    if obj.Fingerprint != "" { fmt.Fprintf(w, "fingerprint %s\n", obj.Fingerprint) }
+    if obj.Sha256 != "" { fmt.Fprintf(w, "sha256 %s\n", obj.Sha256) }
+    for i := 0; i < len(obj.Objects); i++ {
+        digestObject(w, &obj.Objects[i])
+    }
+    fmt.Fprint(w, "}\n")
+}
+
+// Perform various sanity checks on a manifest and its contained object tree
+// against the asset payload loaded along with it and the external payload
+// (which may be nil if there's none). External objects are only checked to lie
+// within the latter; see verifyExternal().
+func verifyManifest(m *Manifest, assets []byte, ext *io.SectionReader) (error) {
     // Verify magic
-    if state.manifest.Magic != MANIFEST_MAGIC {
+    if m.Magic != MANIFEST_MAGIC {
         errstr := "Container has invalid magic value (expected %v, got %v)."
-        errstr = fmt.Sprintf(errstr, MANIFEST_MAGIC, state.manifest.Magic)
+        errstr = fmt.Sprintf(errstr, MANIFEST_MAGIC, m.Magic)
         return debug(errors.New(errstr))
     }
 
     // Verify asset root name tag magic
-    if state.manifest.ObjectRoot.Name != OBJECTROOT_MAGIC {
+    if m.ObjectRoot.Name != OBJECTROOT_MAGIC {
         errstr := "Container has invalid magic value (expected %v, got %v)."
-        errstr = fmt.Sprintf(errstr, OBJECTROOT_MAGIC, state.manifest.ObjectRoot.Name)
+        errstr = fmt.Sprintf(errstr, OBJECTROOT_MAGIC, m.ObjectRoot.Name)
         return debug(errors.New(errstr))
     }
 
-    // Patch object root with correct basename.
-    state.manifest.ObjectRoot.Name = path.Base(state.prefix)
-
     // Verify options
-    emode := state.manifest.Options.ExtractionMode
+    emode := m.Options.ExtractionMode
     if emode != EXTRACT_MEMORY && emode != EXTRACT_TEMP && emode != EXTRACT_EXECUTABLE {
         return debug(errors.New("Bundle specifies unknown extraction mode."))
     }
 
+    // Verify digest
+    if m.Digest != "" && m.Digest != Digest(m, assets) {
+        return debug(errors.New("Container digest mismatch."))
+    }
+
     // Verify object tree
-    if !state.manifest.ObjectRoot.ModeBits.IsDir() {
+    if !m.ObjectRoot.ModeBits.IsDir() {
         return debug(errors.New("Root Object must be a directory."))
     }
 
-    count, err := verifyObject(&state.manifest.ObjectRoot)
+    var extsize int64
+    if ext != nil { extsize = ext.Size() }
+
+    count, extcount, err := verifyObject(&m.ObjectRoot, assets, extsize)
     if err != nil { return debug(err) }
 
     // Verify loaded byte count
-    if count != int64(len(state.assets)) {
-        errstr := "Asset payload size (%v) differs from manifest tally (%v)."
+    if count != int64(len(assets)) || extcount != extsize {
+        errstr := "Asset payload size (%v+%v) differs from manifest tally (%v+%v)."
         errstr += " Something is really, really wrong."
-        errstr = fmt.Sprintf(errstr, len(state.assets), count)
+        errstr = fmt.Sprintf(errstr, len(assets), extsize, count, extcount)
         return debug(errors.New(errstr))
     }
 
@@ -129,41 +241,136 @@ func verifyManifest() (error) {
 }
 
 // Recursively verify an object.
-func verifyObject(obj *Object) (count int64, err error) {
+func verifyObject(obj *Object, assets []byte, extsize int64) (count, extcount int64, err error) {
+    // Whiteout?
+    if obj.Whiteout {
+        if obj.Size != 0 || obj.Offset != 0 || obj.Checksum != 0 || len(obj.Objects) != 0 {
+            return 0, 0, debug(errors.New("Whiteout object does not pass all sanity checks."))
+        }
+        return 0, 0, nil
+    }
+
     // Directory?
     if obj.ModeBits.IsDir() {
-        if obj.Size != 0 || obj.Offset != 0 || obj.Checksum != 0 {
-            return 0, debug(errors.New("Directory object does not pass all sanity checks."))
+        if obj.Size != 0 || obj.Offset != 0 || obj.Checksum != 0 || obj.External || obj.GzipSize != 0 || obj.GzipChecksum != 0 {
+            return 0, 0, debug(errors.New("Directory object does not pass all sanity checks."))
         }
     } else {
         // File
         if obj.Size == 0 {
-            if obj.Offset != 0 || obj.Checksum != 0 {
-                return 0, debug(errors.New("File object does not pass all sanity checks."))
+            if obj.Offset != 0 || obj.Checksum != 0 || obj.External || obj.GzipSize != 0 || obj.GzipChecksum != 0 {
+                return 0, 0, debug(errors.New("File object does not pass all sanity checks."))
             }
         } else {
             if len(obj.Objects) != 0 {
-                return 0, debug(errors.New("File object does not pass all sanity checks."))
+                return 0, 0, debug(errors.New("File object does not pass all sanity checks."))
+            }
+
+            size := int64(len(assets))
+            if obj.External { size = extsize }
+            if obj.Offset < 0 || obj.Offset+obj.Size > size {
+                return 0, 0, debug(errors.New("File object points outside the asset payload."))
             }
-            data, err := getPayload(obj)
-            if err != nil { return 0, err }
-            h := crc32.NewIEEE()
-            h.Write(data)
 
-            if obj.Checksum != h.Sum32() {
-                return 0, debug(errors.New("Checksum error."))
+            // External payloads are only checked when first opened (see
+            // verifyExternal()), as reading them all could take a while.
+            if obj.External {
+                extcount += obj.Size
+            } else {
+                if obj.Checksum != crc32.ChecksumIEEE(assets[obj.Offset:obj.Offset+obj.Size]) {
+                    return 0, 0, debug(errors.New("Checksum error."))
+                }
+                count += obj.Size
             }
 
-            count += obj.Size
+            // The gzip variant is served as is, so it's checked separately.
+            if obj.GzipSize != 0 {
+                if obj.GzipOffset < 0 || obj.GzipSize < 0 || obj.GzipOffset+obj.GzipSize > size {
+                    return 0, 0, debug(errors.New("Gzip variant points outside the asset payload."))
+                }
+
+                if obj.External {
+                    extcount += obj.GzipSize
+                } else {
+                    if obj.GzipChecksum != crc32.ChecksumIEEE(assets[obj.GzipOffset:obj.GzipOffset+obj.GzipSize]) {
+                        return 0, 0, debug(errors.New("Gzip variant checksum error."))
+                    }
+                    count += obj.GzipSize
+                }
+            } else if obj.GzipChecksum != 0 {
+                return 0, 0, debug(errors.New("File object does not pass all sanity checks."))
+            }
         }
     }
 
     // Verify child objects
     for i := 0; i < len(obj.Objects); i++ {
-        bytes, err := verifyObject(&obj.Objects[i])
-        if err != nil { return 0, debug(err) }
+        bytes, extbytes, err := verifyObject(&obj.Objects[i], assets, extsize)
+        if err != nil { return 0, 0, debug(err) }
         count += bytes
+        extcount += extbytes
     }
 
-    return count, nil
+    return count, extcount, nil
+}
+
+// Outcome of checking an external object's payload (see verifyExternal()).
+// Copies of the object share it.
+type extCheck struct {
+    once        sync.Once
+    err         error
+    // Set (atomically) once err holds the outcome.
+    done        uint32
+}
+
+// Check an external object's payload and gzip variant against their
+// checksums. It's done the first time the object is opened rather than by
+// Init(), and the outcome is remembered.
+func verifyExternal(obj *Object) error {
+    if obj.check == nil { return nil }
+    obj.check.once.Do(func() {
+        obj.check.err = checkPayload(obj.ext, obj.Offset, obj.Size, obj.Checksum, "Checksum error.")
+        if obj.check.err == nil && obj.GzipSize != 0 {
+            obj.check.err = checkPayload(obj.ext, obj.GzipOffset, obj.GzipSize, obj.GzipChecksum, "Gzip variant checksum error.")
+        }
+        atomic.StoreUint32(&obj.check.done, 1)
+    })
+    return obj.check.err
+}
+
+// Report whether an external object has been checked yet (see
+// verifyExternal()) and if so, the outcome, without checking it.
+func externalChecked(obj *Object) (bool, error) {
+    if obj.check == nil || atomic.LoadUint32(&obj.check.done) == 0 { return false, nil }
+    return true, obj.check.err
+}
+
+// Check size bytes of an external payload, starting at offset, against a CRC32
+// checksum.
+func checkPayload(ext io.ReaderAt, offset, size int64, checksum uint32, errstr string) error {
+    h := crc32.NewIEEE()
+    _, err := io.Copy(h, io.NewSectionReader(ext, offset, size))
+    if err != nil { return debug(err) }
+    if h.Sum32() != checksum { return debug(errors.New(errstr)) }
+    return nil
+}
+
+// Verify checks every external object in the loaded bundle against its
+// checksum right away. Otherwise, each one is only checked the first time it's
+// opened (Init() does check everything held in RAM), which spares reading
+// large containers in full at startup.
+func Verify() error {
+    if !state.ready { return pathError("verify", state.source, ErrNotReady) }
+    return verifyExternals(&state.manifest.ObjectRoot)
+}
+
+// Recursively check every external object in a tree (see verifyExternal()).
+func verifyExternals(obj *Object) error {
+    err := verifyExternal(obj)
+    if err != nil { return err }
+    for i := 0; i < len(obj.Objects); i++ {
+        err = verifyExternals(&obj.Objects[i])
+        if err != nil { return err }
+    }
+    return nil
 }
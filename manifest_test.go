@@ -0,0 +1,81 @@
+package caviar
+
+import (
+    "bytes"
+    "compress/gzip"
+    "hash/crc32"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// Build a manifest holding a single file with a gzip variant, and its assets.
+func testGzipManifest(t *testing.T) (*Manifest, []byte) {
+    data := []byte(strings.Repeat("compress me ", 100))
+
+    var gz bytes.Buffer
+    w := gzip.NewWriter(&gz)
+    w.Write(data)
+    err := w.Close()
+    if err != nil { t.Fatal(err) }
+
+    m := new(Manifest)
+    m.Magic = MANIFEST_MAGIC
+    m.ObjectRoot.Name = OBJECTROOT_MAGIC
+    m.ObjectRoot.ModeBits = os.ModeDir | 0755
+    m.ObjectRoot.Objects = []Object{{
+        Name:           "a.txt",
+        ModeBits:       0644,
+        Size:           int64(len(data)),
+        Checksum:       crc32.ChecksumIEEE(data),
+        GzipOffset:     int64(len(data)),
+        GzipSize:       int64(gz.Len()),
+        GzipChecksum:   crc32.ChecksumIEEE(gz.Bytes()),
+    }}
+
+    return m, append(data, gz.Bytes()...)
+}
+
+func TestVerifyGzip(t *testing.T) {
+    m, assets := testGzipManifest(t)
+    err := verifyManifest(m, assets, nil)
+    if err != nil { t.Fatal(err) }
+
+    // Corrupt the variant
+    assets[len(assets) - 1] ^= 0xff
+    err = verifyManifest(m, assets, nil)
+    if err == nil { t.Fatal("Corrupt gzip variant passed verification.") }
+}
+
+func TestVerifyExternal(t *testing.T) {
+    payload := strings.Repeat("external payload ", 100)
+    data, err := testContainer(map[string]string{ "index.html": "ok", "ext/a.bin": payload, "ext/b.bin": "b" })
+    if err != nil { t.Fatal(err) }
+
+    // Corrupt the external payload; Init() doesn't read it.
+    i := bytes.Index(data, []byte(payload))
+    data[i + len(payload) - 1] ^= 0xff
+    name := filepath.Join(t.TempDir(), "test." + CAVIAR_EXTENSION)
+    err = ioutil.WriteFile(name, data, 0644)
+    if err != nil { t.Fatal(err) }
+
+    testWithBundle(t, name, func() {
+        for _, name := range []string{ "index.html", "ext/b.bin" } {
+            f, err := CaviarOpen(filepath.Join(state.prefix, name))
+            if err != nil { t.Fatalf("Open(%v) failed: %v", name, err) }
+            f.Close()
+        }
+
+        // Twice, as the outcome is remembered.
+        for i := 0; i < 2; i++ {
+            _, err = CaviarOpen(filepath.Join(state.prefix, "ext/a.bin"))
+            if err == nil { t.Fatal("Opened corrupt external file.") }
+            _, err = ReadFile(filepath.Join(state.prefix, "ext/a.bin"))
+            if err == nil { t.Fatal("Read corrupt external file.") }
+        }
+
+        if Verify() == nil { t.Fatal("Verify() missed corrupt external file.") }
+    })
+}
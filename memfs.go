@@ -0,0 +1,350 @@
+// memfs.go implements an in-memory upper layer for the writable overlay.
+
+package caviar
+
+import (
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "sort"
+    "sync"
+    "syscall"
+    "time"
+)
+
+var errWriteAtInAppendMode = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+
+// memLayer keeps the overlay's upper layer in RAM. Nothing survives a restart.
+type memLayer struct {
+    mu          sync.Mutex
+    nodes       map[string]*memNode
+    whiteouts   map[string]bool
+}
+
+// A file or directory in a memLayer.
+type memNode struct {
+    name        string
+    mode        os.FileMode
+    modTime     time.Time
+    data        []byte
+}
+
+func newMemLayer() *memLayer {
+    return &memLayer{ nodes: make(map[string]*memNode), whiteouts: make(map[string]bool) }
+}
+
+func (l *memLayer) open(rel string, flag int, perm os.FileMode) (File, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, ok := l.nodes[rel]
+    if ok && flag & (os.O_CREATE | os.O_EXCL) == os.O_CREATE | os.O_EXCL { return nil, os.ErrExist }
+    if !ok {
+        if flag & os.O_CREATE == 0 { return nil, os.ErrNotExist }
+        if err := l.checkParent(rel); err != nil { return nil, err }
+        node = &memNode{ name: path.Base(rel), mode: perm.Perm(), modTime: time.Now() }
+        l.nodes[rel] = node
+    }
+
+    if node.mode.IsDir() && flag & WRITE_FLAGS != 0 { return nil, syscall.EISDIR }
+    if flag & os.O_TRUNC != 0 {
+        node.data = nil
+        node.modTime = time.Now()
+    }
+
+    return &memFile{ layer: l, node: node, name: rel, rel: rel, flag: flag }, nil
+}
+
+func (l *memLayer) stat(rel string) (os.FileInfo, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, ok := l.nodes[rel]
+    if !ok { return nil, os.ErrNotExist }
+    return node.info(), nil
+}
+
+func (l *memLayer) readDir(rel string) ([]os.FileInfo, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    var list []os.FileInfo
+    for p, node := range l.nodes {
+        if p != "." && path.Dir(p) == rel { list = append(list, node.info()) }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+    return list, nil
+}
+
+func (l *memLayer) mkdir(rel string, perm os.FileMode) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if _, ok := l.nodes[rel]; ok { return os.ErrExist }
+    if err := l.checkParent(rel); err != nil { return err }
+    l.nodes[rel] = &memNode{ name: path.Base(rel), mode: os.ModeDir | perm.Perm(), modTime: time.Now() }
+    return nil
+}
+
+func (l *memLayer) create(rel string, data []byte, perm os.FileMode, modtime time.Time) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if err := l.checkParent(rel); err != nil { return err }
+    buf := make([]byte, len(data))
+    copy(buf, data)
+    l.nodes[rel] = &memNode{ name: path.Base(rel), mode: perm.Perm(), modTime: modtime, data: buf }
+    return nil
+}
+
+func (l *memLayer) remove(rel string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, ok := l.nodes[rel]
+    if !ok { return os.ErrNotExist }
+    if node.mode.IsDir() {
+        for p := range l.nodes {
+            if path.Dir(p) == rel { return syscall.ENOTEMPTY }
+        }
+        for p := range l.whiteouts {
+            if path.Dir(p) == rel { delete(l.whiteouts, p) }
+        }
+    }
+    delete(l.nodes, rel)
+    return nil
+}
+
+func (l *memLayer) chmod(rel string, mode os.FileMode) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    node, ok := l.nodes[rel]
+    if !ok { return os.ErrNotExist }
+    node.mode = node.mode &^ os.ModePerm | mode.Perm()
+    return nil
+}
+
+func (l *memLayer) whiteout(rel string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.whiteouts[rel] = true
+    return nil
+}
+
+func (l *memLayer) isWhiteout(rel string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.whiteouts[rel]
+}
+
+func (l *memLayer) clearWhiteout(rel string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    delete(l.whiteouts, rel)
+    return nil
+}
+
+// Make sure the parent of rel is a directory. The root always is. Must be
+// called with the lock held.
+func (l *memLayer) checkParent(rel string) error {
+    dir := path.Dir(rel)
+    if dir == "." { return nil }
+    node, ok := l.nodes[dir]
+    if !ok { return os.ErrNotExist }
+    if !node.mode.IsDir() { return syscall.ENOTDIR }
+    return nil
+}
+
+func (n *memNode) info() os.FileInfo {
+    return &memFileInfo{ name: n.name, mode: n.mode, modTime: n.modTime, size: int64(len(n.data)) }
+}
+
+// memFileInfo is a snapshot of a memNode's metadata.
+type memFileInfo struct {
+    name        string
+    mode        os.FileMode
+    modTime     time.Time
+    size        int64
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile implements caviar.File for files in a memLayer. Directories are
+// always opened as CaviarFile, so memFile only ever deals with regular files.
+type memFile struct {
+    layer   *memLayer
+    node    *memNode
+    name    string
+    rel     string
+    flag    int
+    pos     int64
+    closed  bool
+}
+
+func (f *memFile) checkValid(op string, write bool) error {
+    if f.closed { return pathError(op, f.name, os.ErrClosed) }
+    mode := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+    if write && mode == os.O_RDONLY { return pathError(op, f.name, syscall.EBADF) }
+    if !write && mode == os.O_WRONLY { return pathError(op, f.name, syscall.EBADF) }
+    return nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+    if err := f.checkValid("read", false); err != nil { return 0, err }
+    n, err := f.ReadAt(b, f.pos)
+    f.pos += int64(n)
+    if n > 0 && err == io.EOF { err = nil }
+    return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+    if err := f.checkValid("read", false); err != nil { return 0, err }
+    if off < 0 { return 0, pathError("readat", f.name, os.ErrInvalid) }
+
+    f.layer.mu.Lock()
+    defer f.layer.mu.Unlock()
+
+    if off >= int64(len(f.node.data)) {
+        if len(b) == 0 { return 0, nil }
+        return 0, io.EOF
+    }
+    n := copy(b, f.node.data[off:])
+    if n < len(b) { return n, io.EOF }
+    return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+    if err := f.checkValid("write", true); err != nil { return 0, err }
+
+    if f.flag & os.O_APPEND != 0 {
+        f.layer.mu.Lock()
+        f.pos = int64(len(f.node.data))
+        f.layer.mu.Unlock()
+    }
+    n, err := f.writeAt(b, f.pos)
+    f.pos += int64(n)
+    return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+    if err := f.checkValid("write", true); err != nil { return 0, err }
+    if f.flag & os.O_APPEND != 0 {
+        return 0, pathError("writeat", f.name, errWriteAtInAppendMode)
+    }
+    if off < 0 { return 0, pathError("writeat", f.name, os.ErrInvalid) }
+    return f.writeAt(b, off)
+}
+
+func (f *memFile) writeAt(b []byte, off int64) (int, error) {
+    f.layer.mu.Lock()
+    defer f.layer.mu.Unlock()
+
+    end := off + int64(len(b))
+    if end > int64(len(f.node.data)) {
+        data := make([]byte, end)
+        copy(data, f.node.data)
+        f.node.data = data
+    }
+    copy(f.node.data[off:], b)
+    f.node.modTime = time.Now()
+    return len(b), nil
+}
+
+func (f *memFile) WriteString(s string) (int, error) {
+    return f.Write([]byte(s))
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+    if f.closed { return 0, pathError("seek", f.name, os.ErrClosed) }
+
+    f.layer.mu.Lock()
+    size := int64(len(f.node.data))
+    f.layer.mu.Unlock()
+
+    switch whence {
+    case io.SeekStart:
+    case io.SeekCurrent:
+        offset += f.pos
+    case io.SeekEnd:
+        offset += size
+    default:
+        return 0, pathError("seek", f.name, os.ErrInvalid)
+    }
+    if offset < 0 { return 0, pathError("seek", f.name, os.ErrInvalid) }
+
+    f.pos = offset
+    return offset, nil
+}
+
+func (f *memFile) Close() error {
+    if f.closed { return pathError("close", f.name, os.ErrClosed) }
+    f.closed = true
+    return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+    if f.closed { return nil, pathError("stat", f.name, os.ErrClosed) }
+    f.layer.mu.Lock()
+    defer f.layer.mu.Unlock()
+    return f.node.info(), nil
+}
+
+func (f *memFile) Name() string {
+    return f.name
+}
+
+func (f *memFile) Chdir() error {
+    return pathError("chdir", f.name, syscall.ENOTDIR)
+}
+
+func (f *memFile) Sync() error {
+    if f.closed { return pathError("sync", f.name, os.ErrClosed) }
+    return nil
+}
+
+func (f *memFile) Fd() uintptr {
+    return ^uintptr(0)
+}
+
+func (f *memFile) Truncate(size int64) error {
+    if err := f.checkValid("truncate", true); err != nil { return err }
+    if size < 0 { return pathError("truncate", f.name, os.ErrInvalid) }
+
+    f.layer.mu.Lock()
+    defer f.layer.mu.Unlock()
+
+    data := make([]byte, size)
+    copy(data, f.node.data)
+    f.node.data = data
+    f.node.modTime = time.Now()
+    return nil
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+    if f.closed { return pathError("chmod", f.name, os.ErrClosed) }
+    return f.layer.chmod(f.rel, mode)
+}
+
+func (f *memFile) Chown(uid, gid int) error {
+    return pathError("chown", f.name, os.ErrPermission)
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+    return nil, pathError("readdirent", f.name, syscall.ENOTDIR)
+}
+
+func (f *memFile) Readdirnames(n int) ([]string, error) {
+    return nil, pathError("readdirent", f.name, syscall.ENOTDIR)
+}
+
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+    return nil, pathError("readdirent", f.name, syscall.ENOTDIR)
+}
@@ -0,0 +1,62 @@
+// mount.go implements the mount table, which makes bundle subtrees show up at
+// arbitrary absolute paths.
+
+package caviar
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "syscall"
+)
+
+// AddMount makes the bundle subtree at source (a slash-separated path relative
+// to the object root, or "." for the whole bundle) show up at the absolute path
+// target. A mount already at target is replaced, which allows overriding the
+// bundle's own mount table (see BundleOptions.Mounts). Lookups are routed to
+// the mount with the longest target matching the path.
+func AddMount(source, target string) error {
+    if !state.ready { return pathError("mount", target, ErrNotReady) }
+    if !filepath.IsAbs(target) { return pathError("mount", target, os.ErrInvalid) }
+
+    source = path.Clean(source)
+    if _, err := lookupObject(source); err != nil { return pathError("mount", source, err) }
+
+    setMount(Mount{ source, target })
+    return nil
+}
+
+// RemoveMount removes the mount at the absolute path target.
+func RemoveMount(target string) error {
+    target = filepath.Clean(target)
+    for i, m := range state.mounts {
+        if m.Target != target { continue }
+        state.mounts = append(state.mounts[:i], state.mounts[i+1:]...)
+        return nil
+    }
+    return pathError("unmount", target, syscall.EINVAL)
+}
+
+// Mounts returns a copy of the mount table, longest target first.
+func Mounts() []Mount {
+    return append([]Mount(nil), state.mounts...)
+}
+
+// Add or replace a mount, keeping the table sorted longest target first.
+func setMount(m Mount) {
+    m.Source = path.Clean(m.Source)
+    m.Target = filepath.Clean(m.Target)
+
+    for i := 0; i < len(state.mounts); i++ {
+        if state.mounts[i].Target == m.Target {
+            state.mounts[i] = m
+            return
+        }
+    }
+
+    state.mounts = append(state.mounts, m)
+    sort.SliceStable(state.mounts, func(i, j int) bool {
+        return len(state.mounts[i].Target) > len(state.mounts[j].Target)
+    })
+}
@@ -3,35 +3,82 @@
 package caviar
 
 import (
+    "io/fs"
     "os"
-    "errors"
+    "sort"
 )
 
 // Open mimicks os.Open. It will first attempt to open the file as an internal
-// Caviar file and failing that it will pass along the call to the os package.
+// Caviar file and if it doesn't exist it will pass along the call to the os
+// package.
 func Open(name string) (File, error) {
     file, err := CaviarOpen(name)
-    if err != nil { return os.Open(name) }
+    if os.IsNotExist(err) { return os.Open(nativePath(name)) }
+    if err != nil { return nil, err }
     return file, nil
 }
 
 // OpenFile mimicks os.OpenFile. It will first attempt to open the file as an
-// internal Caviar file and failing that it will pass along the call to the os
-// package.
+// internal Caviar file and if it doesn't exist it will pass along the call to
+// the os package. Bundle files can only be opened for writing if the writable
+// overlay is enabled (see EnableOverlay()).
 func OpenFile(name string, flag int, perm os.FileMode) (File, error) {
     file, err := CaviarOpenFile(name, flag, perm)
-    if err != nil { return os.OpenFile(name, flag, perm) }
+    if os.IsNotExist(err) { return os.OpenFile(nativePath(name), flag, perm) }
+    if err != nil { return nil, err }
     return file, nil
 }
 
 // Lstat mimicks os.Lstat(). Please note Caviar does not currently support
 // symlinks inside the bundle so Lstat() will be have identically to Stat() for
-// paths matching files and directories inside the bundle.
-func Lstat(name string) (fi os.FileInfo, err error) {
-    return fi, debug(errors.New("Lstat(): Not Implemented.")) // TODO
+// paths matching files and directories inside the bundle. Paths outside the
+// bundle are passed along to os.Lstat().
+func Lstat(name string) (os.FileInfo, error) {
+    if fi, err := statOverlay(name); err == nil { return fi, nil }
+    obj, err := findObject(name)
+    if err != nil { return os.Lstat(nativePath(name)) }
+    return &CaviarFileInfo{ obj }, nil
+}
+
+// Stat mimicks os.Stat(). Paths outside the bundle are passed along to
+// os.Stat().
+func Stat(name string) (os.FileInfo, error) {
+    if fi, err := statOverlay(name); err == nil { return fi, nil }
+    obj, err := findObject(name)
+    if err != nil { return os.Stat(nativePath(name)) }
+    return &CaviarFileInfo{ obj }, nil
+}
+
+// ReadDirEntries mimicks os.ReadDir(), returning the directory's entries
+// sorted by name. For directories that exist both in the bundle and on disk,
+// the listing merges both, as Readdir() does. Directories outside the bundle
+// are read through the os package.
+func ReadDirEntries(name string) ([]fs.DirEntry, error) {
+    list, err := readDirMerged(name)
+    if err != nil { return nil, err }
+
+    entries := make([]fs.DirEntry, len(list))
+    for i := 0; i < len(list); i++ { entries[i] = fs.FileInfoToDirEntry(list[i]) }
+    return entries, nil
+}
+
+// Return a directory object's children as fs.DirEntry values, sorted by name.
+func dirEntries(obj *Object) []fs.DirEntry {
+    entries := make([]fs.DirEntry, len(obj.Objects))
+    for i := 0; i < len(obj.Objects); i++ {
+        entries[i] = fs.FileInfoToDirEntry(&CaviarFileInfo{ &obj.Objects[i] })
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Name() < entries[j].Name()
+    })
+    return entries
 }
 
-// Stat mimicks os.Stat()
-func Stat(name string) (fi os.FileInfo, err error) {
-    return fi, debug(errors.New("Stat(): Not Implemented.")) // TODO
+// Stat a path through the writable overlay. Fails if the overlay is disabled
+// or the path is in neither of its layers.
+func statOverlay(name string) (os.FileInfo, error) {
+    if state.overlay == nil { return nil, os.ErrNotExist }
+    rel, err := resolve(name)
+    if err != nil { return nil, err }
+    return overlayStat(rel)
 }
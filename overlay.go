@@ -0,0 +1,386 @@
+// overlay.go implements a copy-on-write writable overlay on top of the
+// read-only bundle. Files in the bundle opened for writing are first copied up
+// to the overlay's upper layer (a native directory or RAM), new files are
+// created there, and deletions are recorded as whiteouts. Open, Stat, Readdir
+// and friends then see the merged result.
+
+package caviar
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Flags that make OpenFile modify or create a file.
+const WRITE_FLAGS = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+
+// Prefix of whiteout markers in native upper directories.
+const WHITEOUT_PREFIX = ".wh."
+
+// layer is the overlay's upper layer. Paths are slash-separated and relative
+// to the object root.
+type layer interface {
+    open(rel string, flag int, perm os.FileMode) (File, error)
+    stat(rel string) (os.FileInfo, error)
+    readDir(rel string) ([]os.FileInfo, error)
+    mkdir(rel string, perm os.FileMode) error
+    create(rel string, data []byte, perm os.FileMode, modtime time.Time) error
+    remove(rel string) error
+    chmod(rel string, mode os.FileMode) error
+    whiteout(rel string) error
+    isWhiteout(rel string) bool
+    clearWhiteout(rel string) error
+}
+
+// EnableOverlay turns on the writable overlay. Modified and new files are
+// stored under the native directory upper (which must exist), or in RAM if
+// upper is empty. Whiteouts are recorded in upper as “.wh.NAME” files, so an
+// on-disk overlay persists across restarts.
+func EnableOverlay(upper string) error {
+    if !state.ready { return pathError("overlay", upper, ErrNotReady) }
+    if state.overlay != nil { return pathError("overlay", upper, ErrOverlayEnabled) }
+
+    if upper == "" {
+        state.overlay = newMemLayer()
+        return nil
+    }
+
+    fi, err := os.Stat(upper)
+    if err != nil { return debug(err) }
+    if !fi.IsDir() { return pathError("overlay", upper, syscall.ENOTDIR) }
+
+    state.overlay = diskLayer{ upper }
+    return nil
+}
+
+// Remove mimicks os.Remove(). Removing bundle files and directories requires
+// the writable overlay; paths outside the bundle are passed along to
+// os.Remove().
+func Remove(name string) error {
+    rel, err := resolve(name)
+    if err != nil { return os.Remove(nativePath(name)) }
+
+    if state.overlay == nil {
+        if _, err := findObject(name); err == nil {
+            return pathError("remove", name, os.ErrPermission)
+        }
+        return os.Remove(nativePath(name))
+    }
+
+    fi, uerr := state.overlay.stat(rel)
+    obj := visibleObject(rel)
+    if uerr != nil && obj == nil { return os.Remove(nativePath(name)) }
+
+    // Directories must be empty
+    if (uerr == nil && fi.IsDir()) || (uerr != nil && obj.ModeBits.IsDir()) {
+        dir := obj
+        if dir != nil && !dir.ModeBits.IsDir() { dir = nil }
+        list, err := mergeDir(dir, rel, name)
+        if err != nil { return err }
+        if len(list) != 0 { return pathError("remove", name, syscall.ENOTEMPTY) }
+    }
+
+    if uerr == nil {
+        err = state.overlay.remove(rel)
+        if err != nil { return pathError("remove", name, err) }
+    }
+
+    if obj != nil {
+        err = mkdirUpper(path.Dir(rel))
+        if err == nil { err = state.overlay.whiteout(rel) }
+        if err != nil { return pathError("remove", name, err) }
+    }
+
+    return nil
+}
+
+// Mkdir mimicks os.Mkdir(). Creating directories inside the bundle requires
+// the writable overlay; paths outside the bundle are passed along to
+// os.Mkdir().
+func Mkdir(name string, perm os.FileMode) error {
+    rel, err := resolve(name)
+    if err != nil { return os.Mkdir(nativePath(name), perm) }
+
+    if state.overlay == nil {
+        if _, err := findObject(path.Dir(name)); err == nil {
+            return pathError("mkdir", name, os.ErrPermission)
+        }
+        return os.Mkdir(nativePath(name), perm)
+    }
+
+    if _, err := state.overlay.stat(rel); err == nil || visibleObject(rel) != nil {
+        return pathError("mkdir", name, os.ErrExist)
+    }
+    if !visibleDir(path.Dir(rel)) { return os.Mkdir(nativePath(name), perm) }
+
+    err = mkdirUpper(path.Dir(rel))
+    if err == nil { err = state.overlay.mkdir(rel, perm) }
+    if err == nil { err = unwhiteout(rel) }
+    if err != nil { return pathError("mkdir", name, err) }
+
+    return nil
+}
+
+// Open a file through the overlay, copying bundle files up to the upper layer
+// when opened for writing. Returns os.ErrNotExist if the file is in neither
+// layer and can't be created in the upper one.
+func overlayOpen(name, rel string, flag int, perm os.FileMode) (File, error) {
+    fi, uerr := state.overlay.stat(rel)
+    obj := visibleObject(rel)
+    write := flag & WRITE_FLAGS != 0
+
+    // Directories are always served merged
+    if (uerr == nil && fi.IsDir()) || (uerr != nil && obj != nil && obj.ModeBits.IsDir()) {
+        if write { return nil, pathError("open", name, syscall.EISDIR) }
+        if obj == nil || !obj.ModeBits.IsDir() { obj = dirObject(fi) }
+        return &CaviarFile{ obj: obj, name: name, fd: genFd(obj), native: nativePath(name), rel: rel }, nil
+    }
+
+    // Files already in the upper layer
+    if uerr == nil { return openUpper(name, rel, flag, perm) }
+
+    if !write {
+        if obj == nil { return nil, pathError("open", name, os.ErrNotExist) }
+        if err := verifyExternal(obj); err != nil { return nil, pathError("open", name, err) }
+        return &CaviarFile{ obj: obj, name: name, fd: genFd(obj), native: nativePath(name), rel: rel }, nil
+    }
+
+    // Copy up bundle files
+    if obj != nil {
+        if flag & (os.O_CREATE | os.O_EXCL) == os.O_CREATE | os.O_EXCL {
+            return nil, pathError("open", name, os.ErrExist)
+        }
+
+        data, err := readObject(obj, name)
+        if err != nil { return nil, err }
+
+        err = mkdirUpper(path.Dir(rel))
+        if err == nil {
+            modtime := time.Unix(obj.ModTime, obj.ModTimeNsec)
+            err = state.overlay.create(rel, data, obj.ModeBits.Perm(), modtime)
+        }
+        if err != nil { return nil, pathError("open", name, err) }
+
+        return openUpper(name, rel, flag, perm)
+    }
+
+    // Create new files, as long as they belong in a bundle directory. Files
+    // that exist natively (i.e. logs next to the executable) are left to the
+    // os package rather than shadowed by an empty copy.
+    if flag & os.O_CREATE == 0 || !visibleDir(path.Dir(rel)) {
+        return nil, pathError("open", name, os.ErrNotExist)
+    }
+    if _, err := os.Lstat(nativePath(name)); err == nil {
+        return nil, pathError("open", name, os.ErrNotExist)
+    }
+
+    err := mkdirUpper(path.Dir(rel))
+    if err == nil { err = state.overlay.clearWhiteout(rel) }
+    if err != nil { return nil, pathError("open", name, err) }
+
+    return openUpper(name, rel, flag, perm)
+}
+
+// Open a file in the upper layer. In-memory files report the name they were
+// opened with; native ones report their actual path.
+func openUpper(name, rel string, flag int, perm os.FileMode) (File, error) {
+    f, err := state.overlay.open(rel, flag, perm)
+    if err != nil { return nil, pathError("open", name, err) }
+    if mf, ok := f.(*memFile); ok { mf.name = name }
+    return f, nil
+}
+
+// Stat a file through the overlay. Returns os.ErrNotExist if it's neither in
+// the upper layer nor (visible) in the bundle.
+func overlayStat(rel string) (os.FileInfo, error) {
+    if fi, err := state.overlay.stat(rel); err == nil { return fi, nil }
+    if obj := visibleObject(rel); obj != nil { return &CaviarFileInfo{ obj }, nil }
+    return nil, os.ErrNotExist
+}
+
+// Read a file from the upper layer. The boolean is false if the overlay is
+// disabled or the file isn't in the upper layer, in which case the caller
+// should proceed as usual.
+func readUpper(name string) ([]byte, bool, error) {
+    if state.overlay == nil { return nil, false, nil }
+
+    rel, err := resolve(name)
+    if err != nil { return nil, false, nil }
+    fi, err := state.overlay.stat(rel)
+    if err != nil || fi.IsDir() { return nil, false, nil }
+
+    f, err := openUpper(name, rel, os.O_RDONLY, 0)
+    if err != nil { return nil, true, err }
+    defer f.Close()
+
+    data, err := ioutil.ReadAll(f)
+    return data, true, err
+}
+
+// Change the mode of a bundle file or directory, copying it up to the upper
+// layer first if needed.
+func overlayChmod(name, rel string, mode os.FileMode) error {
+    if _, err := state.overlay.stat(rel); err != nil {
+        if visibleDir(rel) {
+            err = mkdirUpper(rel)
+            if err != nil { return pathError("chmod", name, err) }
+        } else {
+            f, err := overlayOpen(name, rel, os.O_WRONLY, 0)
+            if err != nil { return err }
+            f.Close()
+        }
+    }
+
+    err := state.overlay.chmod(rel, mode)
+    if err != nil { return pathError("chmod", name, err) }
+    return nil
+}
+
+// Return the bundle object for rel, unless it (or any of its parents) has been
+// deleted through the overlay.
+func visibleObject(rel string) *Object {
+    if whiteedOut(rel) { return nil }
+    obj, err := lookupObject(rel)
+    if err != nil { return nil }
+    return obj
+}
+
+// Report whether rel is a directory in either the upper layer or the bundle.
+func visibleDir(rel string) bool {
+    if fi, err := state.overlay.stat(rel); err == nil { return fi.IsDir() }
+    obj := visibleObject(rel)
+    return obj != nil && obj.ModeBits.IsDir()
+}
+
+// Report whether rel or any of its parents has been deleted through the
+// overlay.
+func whiteedOut(rel string) bool {
+    for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+        if state.overlay.isWhiteout(p) { return true }
+    }
+    return false
+}
+
+// Undo the whiteout for rel, which has just been re-created as a directory in
+// the upper layer. The original bundle directory's contents must stay hidden,
+// so they're whited out one by one.
+func unwhiteout(rel string) error {
+    if !state.overlay.isWhiteout(rel) { return nil }
+
+    obj, err := lookupObject(rel)
+    if err == nil && obj.ModeBits.IsDir() {
+        for i := 0; i < len(obj.Objects); i++ {
+            err = state.overlay.whiteout(path.Join(rel, obj.Objects[i].Name))
+            if err != nil { return err }
+        }
+    }
+
+    return state.overlay.clearWhiteout(rel)
+}
+
+// Make sure directory rel and all its parents exist in the upper layer,
+// copying their mode bits from the bundle.
+func mkdirUpper(rel string) error {
+    if rel == "." { return nil }
+    if fi, err := state.overlay.stat(rel); err == nil {
+        if !fi.IsDir() { return syscall.ENOTDIR }
+        return nil
+    }
+
+    err := mkdirUpper(path.Dir(rel))
+    if err != nil { return err }
+
+    perm := os.FileMode(0755)
+    if obj := visibleObject(rel); obj != nil { perm = obj.ModeBits.Perm() }
+    return state.overlay.mkdir(rel, perm)
+}
+
+// Build a directory Object out of an upper layer directory.
+func dirObject(fi os.FileInfo) *Object {
+    mtime := fi.ModTime()
+    return &Object{ Name: fi.Name(), ModeBits: fi.Mode(), ModTime: mtime.Unix(),
+        ModTimeNsec: int64(mtime.Nanosecond()) }
+}
+
+// diskLayer is an upper layer stored in a native directory.
+type diskLayer struct {
+    root    string
+}
+
+func (l diskLayer) path(rel string) string {
+    return filepath.Join(l.root, filepath.FromSlash(rel))
+}
+
+func (l diskLayer) whiteoutPath(rel string) string {
+    return l.path(path.Join(path.Dir(rel), WHITEOUT_PREFIX + path.Base(rel)))
+}
+
+func (l diskLayer) open(rel string, flag int, perm os.FileMode) (File, error) {
+    return os.OpenFile(l.path(rel), flag, perm)
+}
+
+func (l diskLayer) stat(rel string) (os.FileInfo, error) {
+    return os.Stat(l.path(rel))
+}
+
+func (l diskLayer) readDir(rel string) ([]os.FileInfo, error) {
+    list, err := ioutil.ReadDir(l.path(rel))
+    if err != nil { return nil, err }
+
+    // Hide whiteout markers
+    var filtered []os.FileInfo
+    for _, fi := range list {
+        if strings.HasPrefix(fi.Name(), WHITEOUT_PREFIX) { continue }
+        filtered = append(filtered, fi)
+    }
+    return filtered, nil
+}
+
+func (l diskLayer) mkdir(rel string, perm os.FileMode) error {
+    return os.Mkdir(l.path(rel), perm)
+}
+
+func (l diskLayer) create(rel string, data []byte, perm os.FileMode, modtime time.Time) error {
+    err := ioutil.WriteFile(l.path(rel), data, perm)
+    if err != nil { return err }
+    return os.Chtimes(l.path(rel), modtime, modtime)
+}
+
+func (l diskLayer) remove(rel string) error {
+    // Directories may still hold whiteout markers
+    list, err := ioutil.ReadDir(l.path(rel))
+    if err == nil {
+        for _, fi := range list {
+            if !strings.HasPrefix(fi.Name(), WHITEOUT_PREFIX) { return syscall.ENOTEMPTY }
+        }
+        for _, fi := range list {
+            err = os.Remove(filepath.Join(l.path(rel), fi.Name()))
+            if err != nil { return err }
+        }
+    }
+    return os.Remove(l.path(rel))
+}
+
+func (l diskLayer) chmod(rel string, mode os.FileMode) error {
+    return os.Chmod(l.path(rel), mode)
+}
+
+func (l diskLayer) whiteout(rel string) error {
+    return ioutil.WriteFile(l.whiteoutPath(rel), nil, 0644)
+}
+
+func (l diskLayer) isWhiteout(rel string) bool {
+    _, err := os.Lstat(l.whiteoutPath(rel))
+    return err == nil
+}
+
+func (l diskLayer) clearWhiteout(rel string) error {
+    err := os.Remove(l.whiteoutPath(rel))
+    if os.IsNotExist(err) { return nil }
+    return err
+}
@@ -0,0 +1,35 @@
+package caviar
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Files that only exist natively, next to bundle files, must not be shadowed
+// by empty copies in the upper layer when opened for writing.
+func TestOverlayNativeFile(t *testing.T) {
+    err := os.MkdirAll(testPrefix, 0755)
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(testPrefix)
+
+    name := filepath.Join(testPrefix, "app.log")
+    err = ioutil.WriteFile(name, []byte("native\n"), 0644)
+    if err != nil { t.Fatal(err) }
+
+    err = EnableOverlay("")
+    if err != nil { t.Fatal(err) }
+    defer func() { state.overlay = nil }()
+
+    f, err := OpenFile(name, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil { t.Fatal(err) }
+    if _, ok := f.(*os.File); !ok { t.Fatalf("Opened %T, want *os.File.", f) }
+    _, err = f.WriteString("appended\n")
+    f.Close()
+    if err != nil { t.Fatal(err) }
+
+    data, err := ReadFile(name)
+    if err != nil { t.Fatal(err) }
+    if string(data) != "native\nappended\n" { t.Fatalf("Read %q.", data) }
+}
@@ -0,0 +1,125 @@
+// patch.go implements support for patch (delta) bundles. A patch bundle only
+// carries the objects that changed since the bundle it was generated from (the
+// base bundle plus every earlier patch), plus whiteout objects for those that
+// were deleted.
+
+package caviar
+
+import (
+    "os"
+    "fmt"
+)
+
+// ApplyPatch loads the patch bundle in the named file and applies it on top of
+// the currently loaded bundle (the base bundle plus any patches applied so
+// far), which must be the one it was generated against. Patches found next to
+// the executable are applied automatically by Init(), so this is only needed
+// for patches kept elsewhere. ApplyPatch must not be called while Caviar files
+// are open.
+func ApplyPatch(name string) error {
+    if !state.ready { return pathError("patch", name, ErrNotReady) }
+    err := applyPatch(name)
+    if _, ok := err.(*os.PathError); err != nil && !ok {
+        return &os.PathError{ Op: "patch", Path: name, Err: err }
+    }
+    return err
+}
+
+func applyPatch(name string) error {
+    c, err := openContainer(name)
+    if err != nil { return debug(err) }
+    m, assets := c.manifest, c.assets
+
+    // Make sure the patch is intact and meant for the loaded bundle
+    if m.BaseDigest == "" {
+        c.close()
+        return pathError("patch", name, ErrNotPatchBundle)
+    }
+
+    // Patches chain: each one applies on top of the previous one.
+    top := state.digest
+    if n := len(state.patches); n > 0 { top = state.patches[n-1] }
+
+    if m.BaseDigest != top {
+        errstr := "Patch %v applies to bundle %v, but bundle %v is loaded."
+        debug(fmt.Sprintf(errstr, name, m.BaseDigest, top))
+        c.close()
+        return pathError("patch", name, ErrPatchMismatch)
+    }
+
+    err = verifyManifest(m, assets, c.external)
+    if err != nil {
+        c.close()
+        return debug(err)
+    }
+
+    // Merge the patch's assets and object tree into the live ones
+    state.patches = append(state.patches, Digest(m, assets))
+    state.patchfiles = append(state.patchfiles, name)
+    if c.file != nil { state.files = append(state.files, c.file) }
+    attachExternal(&m.ObjectRoot, c.payload())
+    rebaseObject(&m.ObjectRoot, int64(len(state.assets)))
+    state.assets = append(state.assets, assets...)
+    mergeObject(&state.manifest.ObjectRoot, &m.ObjectRoot)
+    dropMemfds()
+
+    debug(fmt.Sprintf("Applied patch %v.", name))
+    return nil
+}
+
+// MergePatch merges the object tree of a patch bundle into that of the bundle
+// it applies to, as ApplyPatch() does. Payload offsets are carried over as is,
+// so the result describes the merged tree but can't be read from (cavundle uses
+// it to compute patches on top of earlier ones).
+func MergePatch(dst, patch *Manifest) {
+    mergeObject(&dst.ObjectRoot, &patch.ObjectRoot)
+}
+
+// Recursively shift payload offsets by base bytes.
+func rebaseObject(obj *Object, base int64) {
+    if obj.Size != 0 && !obj.External { obj.Offset += base }
+    if obj.GzipSize != 0 && !obj.External { obj.GzipOffset += base }
+    for i := 0; i < len(obj.Objects); i++ {
+        rebaseObject(&obj.Objects[i], base)
+    }
+}
+
+// Recursively merge a patch directory object into its counterpart in the live
+// object tree. Files replace their counterparts, directories are merged, and
+// whiteouts remove them altogether.
+func mergeObject(dst *Object, src *Object) {
+    name := dst.Name
+    children := dst.Objects
+    *dst = *src
+    dst.Name = name
+    dst.Objects = children
+
+    for i := 0; i < len(src.Objects); i++ {
+        child := &src.Objects[i]
+
+        // Children aren't necessarily sorted by name (bundles built from
+        // several asset paths list each path's entries in turn), so look
+        // them up one by one.
+        j := childIndex(dst, child.Name)
+        found := j >= 0
+
+        if child.Whiteout {
+            if found { dst.Objects = append(dst.Objects[:j], dst.Objects[j+1:]...) }
+        } else if !found {
+            dst.Objects = append(dst.Objects, *child)
+        } else if child.ModeBits.IsDir() && dst.Objects[j].ModeBits.IsDir() {
+            mergeObject(&dst.Objects[j], child)
+        } else {
+            dst.Objects[j] = *child
+        }
+    }
+}
+
+// Return the index of a directory object's child by name, or -1 if there's no
+// such child.
+func childIndex(dir *Object, name string) int {
+    for i := 0; i < len(dir.Objects); i++ {
+        if dir.Objects[i].Name == name { return i }
+    }
+    return -1
+}
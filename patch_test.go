@@ -0,0 +1,99 @@
+package caviar
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+// Write a container to dir/name and return its path.
+func testWriteBundle(t *testing.T, dir, name string, data []byte) string {
+    name = filepath.Join(dir, name)
+    err := ioutil.WriteFile(name, data, 0644)
+    if err != nil { t.Fatal(err) }
+    return name
+}
+
+// Load the base bundle named base, apply patches to it in the order given and
+// return the first error (see testWithBundle()). If listing isn't empty, it's
+// listed and its entries returned.
+func testApplyPatches(t *testing.T, base string, patches []string, listing string) (names []string, err error) {
+    testWithBundle(t, base, func() {
+        for _, p := range patches {
+            err = ApplyPatch(p)
+            if err != nil { return }
+        }
+        if listing == "" { return }
+
+        obj, lerr := lookupObject(listing)
+        if lerr != nil { t.Fatal(lerr) }
+        for i := 0; i < len(obj.Objects); i++ {
+            names = append(names, obj.Objects[i].Name)
+        }
+    })
+    return names, err
+}
+
+func TestApplyPatchChain(t *testing.T) {
+    dir := t.TempDir()
+
+    data, digest, err := testBundle("", map[string]string{ "index.html": "v1", "css/a.css": "a" })
+    if err != nil { t.Fatal(err) }
+    base := testWriteBundle(t, dir, "prog." + CAVIAR_EXTENSION, data)
+
+    // The first patch adds a file, the second one deletes it and adds another.
+    data, digest, err = testBundle(digest, map[string]string{ "css/new.css": "n" })
+    if err != nil { t.Fatal(err) }
+    first := testWriteBundle(t, dir, "prog.9." + PATCH_EXTENSION, data)
+
+    data, digest, err = testBundle(digest, map[string]string{ "css/new.css": testWhiteout, "css/b.css": "b" })
+    if err != nil { t.Fatal(err) }
+    second := testWriteBundle(t, dir, "prog.10." + PATCH_EXTENSION, data)
+
+    patches, err := PatchNames(filepath.Join(dir, "prog"))
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(patches, []string{ first, second }) {
+        t.Fatalf("PatchNames() returned %v.", patches)
+    }
+
+    names, err := testApplyPatches(t, base, patches, "css")
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(names, []string{ "a.css", "b.css" }) {
+        t.Fatalf("Patched directory holds %v.", names)
+    }
+
+    // Each patch only applies on top of the one before it.
+    _, err = testApplyPatches(t, base, []string{ second }, "")
+    if !errors.Is(err, ErrPatchMismatch) { t.Fatalf("Applying the second patch alone returned %v.", err) }
+    _, err = testApplyPatches(t, base, []string{ second, first }, "")
+    if !errors.Is(err, ErrPatchMismatch) { t.Fatalf("Applying patches out of order returned %v.", err) }
+    _, err = testApplyPatches(t, base, []string{ base }, "")
+    if !errors.Is(err, ErrNotPatchBundle) { t.Fatalf("Applying a base bundle returned %v.", err) }
+}
+
+func TestPatchNames(t *testing.T) {
+    dir := t.TempDir()
+    prog := filepath.Join(dir, "prog")
+    for _, name := range []string{ "prog.10.cvp", "prog.2.cvp", "prog.9.cvp", "other.1.cvp", "prog.cvr" } {
+        testWriteBundle(t, dir, name, nil)
+    }
+
+    patches, err := PatchNames(prog)
+    if err != nil { t.Fatal(err) }
+    want := []string{ prog + ".2.cvp", prog + ".9.cvp", prog + ".10.cvp" }
+    if !reflect.DeepEqual(patches, want) {
+        t.Fatalf("PatchNames() returned %v, want %v.", patches, want)
+    }
+
+    for _, name := range []string{ "prog.09.cvp", "prog.new.cvp" } {
+        testWriteBundle(t, dir, name, nil)
+        _, err = PatchNames(prog)
+        if _, ok := err.(*os.PathError); !ok || !errors.Is(err, ErrPatchName) {
+            t.Fatalf("PatchNames() with %v returned %v.", name, err)
+        }
+        os.Remove(filepath.Join(dir, name))
+    }
+}
@@ -0,0 +1,169 @@
+// url.go implements loading the bundle from an HTTP server, with a local cache
+// so it's only downloaded again when it changes.
+
+package caviar
+
+import (
+    "bitbucket.org/kardianos/osext"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "time"
+)
+
+// How long LoadURL() waits on the server before falling back to the cached
+// copy.
+const LOAD_URL_TIMEOUT = 30 * time.Second
+
+// Validators saved next to a cached bundle, used to revalidate it.
+type urlCacheMeta struct {
+    URL             string
+    ETag            string
+    LastModified    string
+}
+
+// LoadURL loads the bundle from a detached container served over HTTP, instead
+// of from the executable (use it when Init() found no bundle). The container is
+// cached in cacheDir, which is created if needed, and revalidated with
+// If-None-Match and If-Modified-Since on each call, so it's only downloaded
+// again when it changes. New downloads are verified before they replace the
+// cached copy. If the server can't be reached or answers with an error, the
+// cached copy is used. Patch bundles found next to the executable aren't
+// applied; use ApplyPatch() for those.
+func LoadURL(url, cacheDir string) (err error) {
+    if state.ready { return pathError("load", url, ErrAlreadyLoaded) }
+    defer func() { state.err = err }()
+
+    // Setup global state
+    exe, err := osext.Executable()
+    if err != nil { return debug(err) }
+    state.prefix = path.Dir(exe)
+
+    // Bring the cache up to date
+    err = os.MkdirAll(cacheDir, 0755)
+    if err != nil { return debug(err) }
+
+    name, cached := urlCacheName(cacheDir, url)
+    err = fetchURL(url, name)
+    if err != nil {
+        if !cached { return debug(err) }
+        debug(fmt.Sprintf("Using cached copy of %v: %v", url, err))
+    }
+
+    // Load ZIP container
+    c, err := openContainer(name)
+    if err != nil { return debug(err) }
+    err = loadContainer(c, url, CONTAINER_URL)
+    if err != nil { return debug(err) }
+
+    // All done
+    debug("Caviar is ready.")
+    debug(fmt.Sprintf("Loaded %v bytes.", PayloadSize()))
+    state.ready = true
+    return nil
+}
+
+// Return the cache file for a URL, and whether it exists.
+func urlCacheName(cacheDir, url string) (string, bool) {
+    sum := sha256.Sum256([]byte(url))
+    name := filepath.Join(cacheDir, hex.EncodeToString(sum[:16]) + "." + CAVIAR_EXTENSION)
+    _, err := os.Stat(name)
+    return name, err == nil
+}
+
+// Download url to the cache file name, unless the cached copy is still
+// current.
+func fetchURL(url, name string) error {
+    meta := readURLCacheMeta(name, url)
+
+    req, err := http.NewRequest("GET", url, nil)
+    if err != nil { return debug(err) }
+    if meta.ETag != "" { req.Header.Set("If-None-Match", meta.ETag) }
+    if meta.LastModified != "" { req.Header.Set("If-Modified-Since", meta.LastModified) }
+
+    client := &http.Client{ Timeout: LOAD_URL_TIMEOUT }
+    resp, err := client.Do(req)
+    if err != nil { return debug(err) }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotModified && meta.URL != "" {
+        debug(fmt.Sprintf("Cached copy of %v is current.", url))
+        return nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        debug("Unexpected HTTP status: " + resp.Status)
+        return pathError("load", url, ErrHTTPStatus)
+    }
+
+    // Download next to the cached copy, then swap them once verified.
+    tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name) + ".*.tmp")
+    if err != nil { return debug(err) }
+    defer os.Remove(tmp.Name())
+
+    _, err = io.Copy(tmp, resp.Body)
+    if err == nil { err = tmp.Sync() }
+    if cerr := tmp.Close(); err == nil { err = cerr }
+    if err != nil { return debug(err) }
+
+    err = checkContainer(tmp.Name())
+    if err != nil { return debug(err) }
+
+    // Drop the old validators first, so they can't end up paired with the new
+    // container.
+    os.Remove(name + ".json")
+    err = os.Rename(tmp.Name(), name)
+    if err != nil { return debug(err) }
+
+    meta = urlCacheMeta{ url, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified") }
+    err = writeURLCacheMeta(name, meta)
+    if err != nil { debug(err) }
+
+    debug(fmt.Sprintf("Downloaded %v.", url))
+    return nil
+}
+
+// Make sure a downloaded container is an intact base bundle.
+func checkContainer(name string) error {
+    c, err := openContainer(name)
+    if err != nil { return debug(err) }
+    defer c.close()
+
+    if c.manifest.BaseDigest != "" { return pathError("load", name, ErrPatchBundle) }
+    err = verifyManifest(c.manifest, c.assets, c.external)
+    if err != nil { return debug(err) }
+
+    // It's only downloaded once, so check external objects too.
+    attachExternal(&c.manifest.ObjectRoot, c.payload())
+    return debug(verifyExternals(&c.manifest.ObjectRoot))
+}
+
+// Load the validators saved for a cache file. They're ignored unless they
+// were saved for the same URL and the cache file exists.
+func readURLCacheMeta(name, url string) (meta urlCacheMeta) {
+    if _, err := os.Stat(name); err != nil { return urlCacheMeta{} }
+
+    data, err := ioutil.ReadFile(name + ".json")
+    if err != nil { return urlCacheMeta{} }
+
+    err = json.Unmarshal(data, &meta)
+    if err != nil || meta.URL != url { return urlCacheMeta{} }
+    return meta
+}
+
+// Save the validators for a cache file.
+func writeURLCacheMeta(name string, meta urlCacheMeta) error {
+    data, err := json.Marshal(meta)
+    if err != nil { return debug(err) }
+
+    tmp := name + ".json.tmp"
+    err = ioutil.WriteFile(tmp, data, 0644)
+    if err != nil { return debug(err) }
+    return debug(os.Rename(tmp, name + ".json"))
+}
@@ -0,0 +1,72 @@
+package caviar
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// Load a bundle with LoadURL() on a clean slate and return the contents of
+// its index.html. The test bundle is back in place afterwards.
+func testLoadURL(t *testing.T, url, cacheDir string) string {
+    saved := state
+    state = caviarState{}
+    defer func() {
+        for _, f := range state.files { f.Close() }
+        state = saved
+    }()
+
+    err := LoadURL(url, cacheDir)
+    if err != nil { t.Fatal(err) }
+    if state.kind != CONTAINER_URL || state.source != url {
+        t.Fatalf("Loaded %v container from %v.", state.kind, state.source)
+    }
+
+    obj, err := lookupObject("index.html")
+    if err != nil { t.Fatal(err) }
+    data, err := readObject(obj, "index.html")
+    if err != nil { t.Fatal(err) }
+    return string(data)
+}
+
+func TestLoadURL(t *testing.T) {
+    v1, err := testContainer(map[string]string{ "index.html": "v1" })
+    if err != nil { t.Fatal(err) }
+    v2, err := testContainer(map[string]string{ "index.html": "v2" })
+    if err != nil { t.Fatal(err) }
+
+    // What the server serves, and how it answered last
+    etag, body, status := `"1"`, v1, 0
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("ETag", etag)
+        if r.Header.Get("If-None-Match") == etag {
+            status = http.StatusNotModified
+            w.WriteHeader(status)
+            return
+        }
+        status = http.StatusOK
+        w.Write(body)
+    }))
+    defer srv.Close()
+
+    url, cache := srv.URL + "/bundle.cvr", t.TempDir()
+    step := func(what, want string, wantStatus int) {
+        got := testLoadURL(t, url, cache)
+        if got != want || status != wantStatus {
+            t.Fatalf("%v: got %q (HTTP %v), want %q (HTTP %v).", what, got, status, want, wantStatus)
+        }
+    }
+
+    step("First download", "v1", http.StatusOK)
+    step("Revalidation", "v1", http.StatusNotModified)
+
+    etag, body = `"2"`, v2
+    step("Changed bundle", "v2", http.StatusOK)
+
+    etag, body = `"3"`, []byte("corrupt")
+    step("Corrupt download", "v2", http.StatusOK)
+
+    srv.Close()
+    status = 0
+    step("Server down", "v2", 0)
+}
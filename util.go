@@ -3,7 +3,13 @@
 package caviar
 
 import (
+    "bytes"
+    "io"
+    "io/ioutil"
     "log"
+    "sort"
+    "strconv"
+    "syscall"
     "errors"
     "strings"
     "time"
@@ -24,6 +30,49 @@ func DetachedName(p string) string {
     return p + "." + CAVIAR_EXTENSION
 }
 
+// Name of the ELF section containers are embedded in.
+const ELF_SECTION = ".caviar"
+
+// File extension for Caviar patch containers.
+const PATCH_EXTENSION = "cvp"
+
+// Returns the names of all patch containers for a given program “p”, sorted in
+// the order they must be applied. Patches for “/opt/myprogram” are expected to
+// be named “/opt/myprogram.<N>.cvp”, where N is their sequence number (see
+// PatchSequence()), and are sorted numerically (so 10 comes after 9).
+func PatchNames(p string) ([]string, error) {
+    base := strings.TrimSuffix(DetachedName(p), "." + CAVIAR_EXTENSION)
+    names, err := filepath.Glob(base + ".*." + PATCH_EXTENSION)
+    if err != nil { return nil, debug(err) }
+
+    seqs := make(map[string]uint64)
+    seen := make(map[uint64]string)
+    for _, name := range names {
+        seq, err := PatchSequence(name)
+        if err != nil { return nil, err }
+        if other, ok := seen[seq]; ok {
+            debug("Same sequence number as " + other + ": " + name)
+            return nil, pathError("patch", name, ErrPatchName)
+        }
+        seqs[name], seen[seq] = seq, name
+    }
+
+    sort.Slice(names, func(i, j int) bool { return seqs[names[i]] < seqs[names[j]] })
+    return names, nil
+}
+
+// PatchSequence returns the sequence number of the patch container named
+// “<program>.<N>.cvp”. Each patch applies on top of the base bundle and every
+// patch numbered before it.
+func PatchSequence(name string) (uint64, error) {
+    stem := strings.TrimSuffix(name, "." + PATCH_EXTENSION)
+    seq, err := strconv.ParseUint(strings.TrimPrefix(filepath.Ext(stem), "."), 10, 64)
+    if stem == name || err != nil {
+        return 0, pathError("patch", name, ErrPatchName)
+    }
+    return seq, nil
+}
+
 // Returns the total number of bytes for all loaded assets.
 func PayloadSize() int64 {
     return int64(len(state.assets))
@@ -37,9 +86,33 @@ func getPayload(obj *Object) ([]byte, error) {
     if obj.Size == 0 {
         return nil, debug(errors.New("The file is empty!"))
     }
+    if obj.External {
+        return nil, debug(errors.New("The file's payload is not held in memory!"))
+    }
     return state.assets[obj.Offset:obj.Offset+obj.Size], nil
 }
 
+// Given a file Object, return an io.ReaderAt for the object's data, regardless
+// of whether it's held in RAM or read from the container file.
+func getPayloadReader(obj *Object) (io.ReaderAt, error) {
+    if obj.External && !obj.ModeBits.IsDir() && obj.Size != 0 {
+        err := verifyExternal(obj)
+        if err != nil { return nil, err }
+        return io.NewSectionReader(obj.ext, obj.Offset, obj.Size), nil
+    }
+    data, err := getPayload(obj)
+    if err != nil { return nil, err }
+    return bytes.NewReader(data), nil
+}
+
+// Return a reader for an object's precompressed gzip variant, or nil if it has
+// none.
+func getGzipReader(obj *Object) io.ReaderAt {
+    if obj.GzipSize == 0 { return nil }
+    if obj.External { return io.NewSectionReader(obj.ext, obj.GzipOffset, obj.GzipSize) }
+    return bytes.NewReader(state.assets[obj.GzipOffset:obj.GzipOffset+obj.GzipSize])
+}
+
 // Self-explanatory debug helpers.
 func isDebug() bool {
     return state.manifest.Options.Debug
@@ -55,6 +128,33 @@ func debug(v interface{}) error {
     return errors.New("debug(): Got message of unknown type.")
 }
 
+// Build an *os.PathError the way the os package would (and log it).
+func pathError(op, name string, err error) error {
+    return debug(&os.PathError{ Op: op, Path: name, Err: err })
+}
+
+// Errors returned (wrapped in an *os.PathError) by functions other than the os
+// and io/ioutil replacements. Test for them with errors.Is().
+var (
+    // Caviar hasn't loaded a bundle yet (see Init()).
+    ErrNotReady = errors.New("caviar: not ready")
+    // Init() or LoadURL() has already loaded a bundle.
+    ErrAlreadyLoaded = errors.New("caviar: bundle already loaded")
+    // EnableOverlay() has already been called.
+    ErrOverlayEnabled = errors.New("caviar: overlay already enabled")
+    // A patch bundle was found where a base bundle was expected.
+    ErrPatchBundle = errors.New("caviar: is a patch bundle")
+    // A base bundle was found where a patch bundle was expected.
+    ErrNotPatchBundle = errors.New("caviar: not a patch bundle")
+    // A patch bundle applies to another bundle than the one loaded.
+    ErrPatchMismatch = errors.New("caviar: patch applies to another bundle")
+    // A patch bundle isn't named “<program>.<N>.cvp”, or shares N with
+    // another one (see PatchNames()).
+    ErrPatchName = errors.New("caviar: bad patch file name")
+    // The server answered LoadURL() with a status other than 200 or 304.
+    ErrHTTPStatus = errors.New("caviar: unexpected HTTP status")
+)
+
 // CaviarOpen behaves the same way as Open but it will only attempt to open
 // files and directories contained within the bundle and will not pass along
 // the call to os.Open() on failure.
@@ -62,63 +162,192 @@ func CaviarOpen(name string) (File, error) {
     return CaviarOpenFile(name, 0, 0)
 }
 
-// CaviarOpenFile is to OpenFile what CaviarOpen is to Open.
+// CaviarOpenFile is to OpenFile what CaviarOpen is to Open. Opening files for
+// writing requires the writable overlay (see EnableOverlay()); without it,
+// doing so fails with os.ErrPermission.
 func CaviarOpenFile(name string, flag int, perm os.FileMode) (File, error) {
-    if !state.ready { return nil, debug(errors.New("Caviar is not ready.")) }
+    rel, err := resolve(name)
+    if err != nil { return nil, pathError("open", name, err) }
 
-    // TODO: Validate flags and permissions (can't open a Caviar file for
-    // writing, after all).
+    if state.overlay != nil { return overlayOpen(name, rel, flag, perm) }
 
-    obj, err := findObject(name)
-    if err != nil { return nil, debug(err) }
+    obj, err := lookupObject(rel)
+    if err != nil { return nil, pathError("open", name, err) }
+    if flag & WRITE_FLAGS != 0 { return nil, pathError("open", name, os.ErrPermission) }
+    if err := verifyExternal(obj); err != nil { return nil, pathError("open", name, err) }
 
-    return &CaviarFile{ obj, genFd(obj), 0 }, nil
+    return &CaviarFile{ obj: obj, name: name, fd: genFd(obj), native: nativePath(name), rel: rel }, nil
 }
 
-// Given a path, find the corresponding Object. Returns an error if not found.
+// Given a path, find the corresponding Object. Returns os.ErrNotExist if not
+// found (or if Caviar is not ready).
 func findObject(name string) (obj *Object, err error) {
+    rel, err := resolve(name)
+    if err != nil { return nil, err }
+
+    // Deleted through the overlay?
+    if state.overlay != nil && whiteedOut(rel) {
+        debug("Caviar file deleted: " + name)
+        return nil, os.ErrNotExist
+    }
+
+    return lookupObject(rel)
+}
+
+// Given a path, return the equivalent slash-separated path relative to the
+// object root. Returns os.ErrNotExist if the path lies outside of every mount
+// (or if Caviar is not ready).
+func resolve(name string) (rel string, err error) {
+    if !state.ready {
+        debug("Caviar is not ready.")
+        return "", os.ErrNotExist
+    }
+
     // TODO: Handle volumes names and implement case-insensitive matches for
     // Windows support.
 
     // Turn relative paths to absolute paths
-    if !path.IsAbs(name) {
-        name, err = filepath.Abs(filepath.Clean(name))
-        if err != nil { return nil, debug(err) }
-    }
+    name, err = absPath(name)
+    if err != nil { return "", err }
+
+    // Route the path through the mount with the longest matching target
+    for _, m := range state.mounts {
+        if name == m.Target { return m.Source, nil }
 
-    // Does the path refer to the object root specifically?
-    if name == state.prefix {
-        return &state.manifest.ObjectRoot, nil
+        dir := m.Target
+        if !strings.HasSuffix(dir, string(os.PathSeparator)) { dir += string(os.PathSeparator) }
+        if strings.HasPrefix(name, dir) {
+            return path.Join(m.Source, filepath.ToSlash(name[len(dir):])), nil
+        }
     }
 
-    // Does it even point to a file inside the object root?
-    if !strings.HasPrefix(name, state.prefix) {
-        return nil, debug(errors.New("Caviar file not found: " + name))
+    debug("Caviar file not found: " + name)
+    return "", os.ErrNotExist
+}
+
+// Given a slash-separated path relative to the object root, find the
+// corresponding Object. Returns os.ErrNotExist if not found.
+func lookupObject(name string) (*Object, error) {
+    if !state.ready {
+        debug("Caviar is not ready.")
+        return nil, os.ErrNotExist
     }
 
-    // Turn absolute path into a relative path within the object root
-    name = name[len(state.prefix)+1:]
+    curobj := &state.manifest.ObjectRoot
+    if name == "" || name == "." { return curobj, nil }
 
     // Find object
-    segments := strings.Split(name, string(os.PathSeparator))
-    curobj := &state.manifest.ObjectRoot
-    for _, segment := range segments {
+    for _, segment := range strings.Split(name, "/") {
         match := false
-        for i, o := range curobj.Objects {
-            if o.Name == segment {
+        for i := 0; i < len(curobj.Objects); i++ {
+            if curobj.Objects[i].Name == segment {
                 curobj = &curobj.Objects[i]
                 match = true
                 break
             }
         }
         if !match {
-            return nil, debug(errors.New("Caviar file not found: " + name))
+            debug("Caviar file not found: " + name)
+            return nil, os.ErrNotExist
         }
     }
 
     return curobj, nil
 }
 
+// Return the merged listing of a directory, combining the entries of the
+// bundle directory (including the writable overlay, if enabled) and those of
+// the native OS directory at the same path, if any. Entries with the same name
+// are resolved as per SetPrecedence(). The listing is sorted by name, and never
+// nil unless there's an error.
+func readDirMerged(name string) ([]os.FileInfo, error) {
+    rel, err := resolve(name)
+    if err != nil { return mergeDir(nil, "", name) }
+
+    var obj *Object
+    if state.overlay != nil {
+        // A directory in the upper layer shadows a bundle file, and vice
+        // versa.
+        fi, uerr := state.overlay.stat(rel)
+        obj = visibleObject(rel)
+        if (uerr == nil && !fi.IsDir()) || (uerr != nil && obj != nil && !obj.ModeBits.IsDir()) {
+            return nil, pathError("readdirent", name, syscall.ENOTDIR)
+        }
+        if obj != nil && !obj.ModeBits.IsDir() { obj = nil }
+    } else {
+        obj, _ = lookupObject(rel)
+    }
+
+    list, err := mergeDir(obj, rel, name)
+    if list == nil && err == nil { list = []os.FileInfo{} }
+    return list, err
+}
+
+// Merge the listing of a bundle directory (which may be nil) and its overlay
+// counterpart (skipped if rel is empty) with that of a native one (skipped if
+// native is empty).
+func mergeDir(obj *Object, rel string, native string) ([]os.FileInfo, error) {
+    var bundled, nativelist, list []os.FileInfo
+    found := obj != nil
+
+    if obj != nil && !obj.ModeBits.IsDir() {
+        return nil, pathError("readdirent", native, syscall.ENOTDIR)
+    }
+
+    // Overlay entries go first, as they shadow bundle ones.
+    if rel != "" && state.overlay != nil {
+        if fi, err := state.overlay.stat(rel); err == nil && fi.IsDir() {
+            found = true
+            bundled, err = state.overlay.readDir(rel)
+            if err != nil { return nil, err }
+        }
+    }
+
+    if obj != nil {
+        for i := 0; i < len(obj.Objects); i++ {
+            child := &obj.Objects[i]
+            if rel != "" && state.overlay != nil && state.overlay.isWhiteout(path.Join(rel, child.Name)) {
+                continue
+            }
+            bundled = append(bundled, &CaviarFileInfo{ child })
+        }
+    }
+
+    if native != "" {
+        var err error
+        nativelist, err = ioutil.ReadDir(nativePath(native))
+        if err != nil && !found { return nil, err }
+    }
+
+    // Whoever goes first wins.
+    first, second := bundled, nativelist
+    if state.precedence == PRECEDENCE_NATIVE { first, second = nativelist, bundled }
+
+    seen := make(map[string]bool)
+    for _, fi := range append(first, second...) {
+        if seen[fi.Name()] { continue }
+        seen[fi.Name()] = true
+        list = append(list, fi)
+    }
+
+    sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+    return list, nil
+}
+
+const (
+    // Bundle entries shadow native ones with the same name (the default).
+    PRECEDENCE_BUNDLE   = iota
+    // Native entries shadow bundle ones with the same name.
+    PRECEDENCE_NATIVE
+)
+
+// SetPrecedence sets which side wins when a directory listing (Readdir, Walk,
+// Glob, etc.) merges bundle and native entries with the same name. See
+// PRECEDENCE_* constants.
+func SetPrecedence(p int) {
+    state.precedence = p
+}
+
 // Generate a probably unique FD.
 func genFd(obj *Object) int64 {
     return int64(obj.Checksum) + time.Now().Unix()